@@ -7,8 +7,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/assetnote/h2csmuggler/http2"
@@ -32,9 +34,26 @@ var (
 	}
 	DefaultTransport = &http2.Transport{
 		AllowHTTP: true,
+		// block concurrent requests on the server's stream limit, rather than failing them
+		StrictMaxConcurrentStreams: true,
+	}
+	DefaultTimeouts = Timeouts{
+		Dial:         time.Millisecond * time.Duration(5000),
+		TLSHandshake: time.Millisecond * time.Duration(5000),
+		Upgrade:      http2.DefaultH2CTimeout,
 	}
 )
 
+// Timeouts bound each phase of a smuggled request. A zero value disables the timeout
+// for that phase, other than the Upgrade phase which falls back to http2.DefaultH2CTimeout
+// Cancelling the context passed to DoContext or DoUpgradeContext aborts whichever phase is running
+type Timeouts struct {
+	Dial         time.Duration // establishing the tcp connection
+	TLSHandshake time.Duration // completing the tls handshake for https targets
+	Upgrade      time.Duration // sending the upgrade request and reading the HTTP/1.1 response
+	Response     time.Duration // waiting for the response headers of each stream
+}
+
 type ConnectionOption func(c *Conn)
 
 func ConnectionTransport(t *http2.Transport) ConnectionOption {
@@ -55,6 +74,99 @@ func ConnectionMaxRetries(v int) ConnectionOption {
 	}
 }
 
+func ConnectionTimeouts(t Timeouts) ConnectionOption {
+	return func(c *Conn) {
+		c.timeouts = t
+	}
+}
+
+// ConnectionPriorKnowledge will start the http2 connection by sending the client preface
+// directly over the tcp or tls connection (h2c with prior knowledge), instead of upgrading
+// from HTTP/1.1. Upgrade options are ignored when this is enabled
+func ConnectionPriorKnowledge(v bool) ConnectionOption {
+	return func(c *Conn) {
+		c.priorKnowledge = v
+	}
+}
+
+// ConnectionResolver will resolve target hosts with r instead of the dialer's resolver.
+// Use SystemResolver for the operating system's resolver, NewResolver for custom nameservers
+// and NewCachingResolver to share lookups between connections
+func ConnectionResolver(r Resolver) ConnectionOption {
+	return func(c *Conn) {
+		c.resolver = r
+	}
+}
+
+// ConnectionResolveOverride will connect to addr whenever hostport is dialed, similar to
+// curl's --resolve. hostport must include the port e.g. example.com:443
+func ConnectionResolveOverride(hostport string, addr string) ConnectionOption {
+	return func(c *Conn) {
+		if c.resolveOverrides == nil {
+			c.resolveOverrides = make(map[string]string)
+		}
+		c.resolveOverrides[hostport] = addr
+	}
+}
+
+// ConnectionUpgradeOptions will apply opts to every upgrade performed by the connection,
+// before any options passed to DoUpgrade
+func ConnectionUpgradeOptions(opts ...UpgradeOption) ConnectionOption {
+	return func(c *Conn) {
+		c.upgradeOpts = append(c.upgradeOpts, opts...)
+	}
+}
+
+// ConnectionSettings will send settings in the SETTINGS frame of the client preface, and
+// encode them as the HTTP2-Settings header of the upgrade, so both always agree. Settings are
+// sent as is, so invalid or duplicate values can be used to test how servers handle them.
+// To send a different HTTP2-Settings header, use SetHTTP2Settings or SetHTTP2SettingsHeader
+func ConnectionSettings(settings ...http2.Setting) ConnectionOption {
+	return func(c *Conn) {
+		c.settings = append(c.settings, settings...)
+	}
+}
+
+// ConnectionFrameObserver will pass every http2 frame read or written by the connection to
+// the observer returned by fn. fn is called once for each Conn with its target, so that each
+// connection can keep its own transcript
+func ConnectionFrameObserver(fn func(target *url.URL) http2.FrameObserver) ConnectionOption {
+	return func(c *Conn) {
+		c.frameObserver = fn
+	}
+}
+
+// ConnectionPushHandler will enable server push on the connection. Each request promised by
+// the server is passed to h with its response, along with the smuggled request which caused it
+func ConnectionPushHandler(h http2.PushHandler) ConnectionOption {
+	return func(c *Conn) {
+		c.pushHandler = h
+	}
+}
+
+// Limiter bounds the rate of an operation. Wait blocks until the operation may proceed, or
+// returns an error if ctx is done first
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// ConnectionLimiter will wait on l before dialing each connection, including retries and
+// re-upgrades. Sharing l between Conns bounds the rate that new tunnels are established
+func ConnectionLimiter(l Limiter) ConnectionOption {
+	return func(c *Conn) {
+		c.limiter = l
+	}
+}
+
+// ConnectionResponseObserver will call fn with the response or error of each request sent
+// over the connection, including the upgrade request. fn is called before the response body
+// is read, so it must not read or close it
+func ConnectionResponseObserver(fn func(res *http.Response, err error)) ConnectionOption {
+	return func(c *Conn) {
+		c.responseObserver = fn
+	}
+}
+
 // NewConn will return an unitialized h2csmuggler connection.
 // The first will Do will initialize the connection and perform the upgrade.
 // Target must be a parsable url including protocol e.g. https://google.com
@@ -64,8 +176,10 @@ func ConnectionMaxRetries(v int) ConnectionOption {
 func NewConn(target string, opts ...ConnectionOption) (*Conn, error) {
 	var err error
 	var c Conn = Conn{
-		dialer:    DefaultDialer,
-		transport: DefaultTransport,
+		dialer:      DefaultDialer,
+		transport:   DefaultTransport,
+		timeouts:    DefaultTimeouts,
+		upgradeLock: make(chan struct{}, 1),
 	}
 
 	c.url, err = url.Parse(target)
@@ -76,26 +190,61 @@ func NewConn(target string, opts ...ConnectionOption) (*Conn, error) {
 	for _, o := range opts {
 		o(&c)
 	}
+	if c.settings != nil || c.frameObserver != nil || c.pushHandler != nil {
+		c.transport = c.transport.Clone()
+	}
+	if c.settings != nil {
+		c.transport.Settings = c.settings
+	}
+	if c.frameObserver != nil {
+		c.transport.FrameObserver = c.frameObserver(c.url)
+	}
+	if c.pushHandler != nil {
+		c.transport.PushHandler = c.pushHandler
+	}
 	return &c, nil
 }
 
-// Conn encapsulates all the state needed to perform a request over h2c. Internally, this is
-// a singlethreaded connection. Functions can be called concurrently, however they will block
-// on the same thread. For concurrent connections, multiple Conns should be instantiated
+// Conn encapsulates all the state needed to perform a request over h2c. Once upgraded, Do
+// is safe for concurrent use and each request is multiplexed as a separate stream over the
+// same connection. The number of concurrent streams is limited by the server's
+// SETTINGS_MAX_CONCURRENT_STREAMS, with callers blocking until a stream is available.
 // Initialization of the connection is lazily performed to allow for the caller to customise
-// the request used to upgrade the connection
+// the request used to upgrade the connection. Only one upgrade is performed at a time,
+// concurrent callers will wait for the upgrade to finish before sending their request
 // Instantiating a Conn should be done via Client
 type Conn struct {
 	url        *url.URL
 	dialer     *net.Dialer
 	transport  *http2.Transport
 	maxRetries int
+	timeouts   Timeouts
+
+	upgradeOpts []UpgradeOption // applied before the options passed to DoUpgrade
+	settings    []http2.Setting // if non-nil, sent instead of the transport's settings
+
+	frameObserver    func(target *url.URL) http2.FrameObserver
+	pushHandler      http2.PushHandler
+	responseObserver func(res *http.Response, err error)
+
+	priorKnowledge bool
+
+	resolver         Resolver
+	resolveOverrides map[string]string // host:port to address
+	proxy            *url.URL
+	noProxy          []string // hosts dialed directly rather than through the proxy
+	limiter          Limiter  // if non-nil, waited on before each dial
+
+	tlsConfig *tls.Config
+	sni       *string // if non-nil, overrides the url hostname
 
 	conn net.Conn
 	h2c  *http2.ClientConn
 
-	init   bool
-	initmu sync.RWMutex
+	upgradeLock chan struct{} // held while upgrading
+	init        bool
+	result      *UpgradeResult // the most recent upgrade attempt
+	initmu      sync.RWMutex
 }
 
 // Initialized will return whether this connection has been initialized already
@@ -114,6 +263,35 @@ func (c *Conn) setInitialized() {
 
 }
 
+// UpgradeResult will return the result of the most recent attempt to upgrade the connection,
+// or nil if no upgrade has been attempted. This is available whether or not the upgrade
+// succeeded
+func (c *Conn) UpgradeResult() *UpgradeResult {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	return c.result
+}
+
+func (c *Conn) setUpgradeResult(r *UpgradeResult) {
+	c.initmu.Lock()
+	defer c.initmu.Unlock()
+	c.result = r
+}
+
+// lockUpgrade will wait until no other upgrade is in progress, or the context is done
+func (c *Conn) lockUpgrade(ctx context.Context) error {
+	select {
+	case c.upgradeLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Conn) unlockUpgrade() {
+	<-c.upgradeLock
+}
+
 // Close will close the underlying connections. After this is called, the struct is no
 // longer safe to use
 func (c *Conn) Close() {
@@ -125,25 +303,67 @@ func (c *Conn) Close() {
 	}
 }
 
+// Ping will send a http2 PING over the upgraded connection and wait for the server to
+// acknowledge it. This can be used as a health check for an idle connection
+func (c *Conn) Ping(ctx context.Context) error {
+	if !c.Initialized() {
+		return ErrNotInitialized
+	}
+	return c.h2c.Ping(ctx)
+}
+
+// canTakeNewRequest reports whether the upgraded connection can take a new stream, meaning it
+// has not been closed, or received or sent a GOAWAY
+func (c *Conn) canTakeNewRequest() bool {
+	return c.Initialized() && c.h2c.CanTakeNewRequest()
+}
+
+// retire will gracefully shut down the connection in the background. New requests are refused
+// by the server, while in-flight streams are given up to timeout to complete
+func (c *Conn) retire(timeout time.Duration) {
+	go func() {
+		if c.Initialized() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			c.h2c.Shutdown(ctx)
+			cancel()
+		}
+		c.Close()
+	}()
+}
+
 // UpgradeOption provides manipulation of the initial upgrade request
 type UpgradeOption func(o *UpgradeOptions)
 
 var (
-	DefaultConnectionHeader    = "Upgrade, HTTP2-Settings"
-	DefaultUpgradeHeader       = "h2c"
+	DefaultConnectionHeader = "Upgrade, HTTP2-Settings"
+	DefaultUpgradeHeader    = "h2c"
+
+	// DefaultHTTP2SettingsHeader was the HTTP2-Settings header sent with every upgrade.
+	//
+	// Deprecated: the header is now encoded from the connection's settings, so that it matches
+	// the SETTINGS sent in the client preface. Use SetHTTP2SettingsHeader to send this value
 	DefaultHTTP2SettingsHeader = "AAMAAABkAARAAAAAAAIAAAAA"
 )
 
 // UpgradeOptions provide manual overrides for the specific headers needed to upgrade
 // the connection to h2c. Fiddling with these may result in an unsuccessful connection
 type UpgradeOptions struct {
-	ConnectionHeader    string
+	ConnectionHeader string
+	UpgradeHeader    string
+
+	// HTTP2SettingsHeader is the HTTP2-Settings header value. If empty, the settings sent
+	// in the client preface are encoded
 	HTTP2SettingsHeader string
-	UpgradeHeader       string
 
 	ConnectionHeaderDisabled    bool
 	HTTP2SettingsHeaderDisabled bool
 	UpgradeHeaderDisabled       bool
+
+	// Raw, if set, is written verbatim as the upgrade request. See UpgradeRaw
+	Raw *RawUpgrade
+
+	// WebSocketVersion is the Sec-WebSocket-Version header of websocket upgrades
+	WebSocketVersion string
 }
 
 func DisableHTTP2SettingsHeader(val bool) UpgradeOption {
@@ -164,12 +384,33 @@ func DisableConnectionHeader(val bool) UpgradeOption {
 	}
 }
 
+// newUpgradeOptions will return the default upgrade options with opts applied
+func newUpgradeOptions(opts ...UpgradeOption) UpgradeOptions {
+	o := UpgradeOptions{
+		ConnectionHeader: DefaultConnectionHeader,
+		UpgradeHeader:    DefaultUpgradeHeader,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 func SetHTTP2SettingsHeader(val string) UpgradeOption {
 	return func(o *UpgradeOptions) {
 		o.HTTP2SettingsHeader = val
 	}
 }
 
+// SetHTTP2Settings will encode settings as the HTTP2-Settings header, regardless of the
+// settings sent in the client preface. This allows for the header and the preface to
+// deliberately disagree
+func SetHTTP2Settings(settings ...http2.Setting) UpgradeOption {
+	return func(o *UpgradeOptions) {
+		o.HTTP2SettingsHeader = http2.EncodeSettings(settings)
+	}
+}
+
 func SetUpgradeHeader(val string) UpgradeOption {
 	return func(o *UpgradeOptions) {
 		o.UpgradeHeader = val
@@ -184,35 +425,63 @@ func SetConnectionHeader(val string) UpgradeOption {
 
 var (
 	ErrUnexpectedScheme = errors.New("Unexpected scheme for connection")
+	ErrResponseTimeout  = errors.New("h2csmuggler: timed out waiting for response headers")
+	ErrNotInitialized   = errors.New("h2csmuggler: connection not initialized")
 )
 
 // CreateConn will create a net.Conn from the URL. This will choose between a tls
 // and a normal tcp connection based on the url scheme
 func CreateConn(t *url.URL, dialer *net.Dialer) (ret net.Conn, err error) {
-	switch t.Scheme {
+	c := &Conn{
+		url:      t,
+		dialer:   dialer,
+		timeouts: DefaultTimeouts,
+	}
+	return c.createConn(context.Background(), &UpgradeTimings{})
+}
+
+// createConn will create a net.Conn to the conn's url, bounded by the dial and tls handshake
+// timeouts. The time taken by each is recorded in timings
+func (c *Conn) createConn(ctx context.Context, timings *UpgradeTimings) (ret net.Conn, err error) {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, errors.Wrap(err, "h2csmuggler: limiter")
+		}
+	}
+	switch c.url.Scheme {
 	case "https":
-		hostport := t.Host
-		if t.Port() == "" {
-			hostport = fmt.Sprintf("%s:%d", t.Host, 443)
+		hostport := c.url.Host
+		if c.url.Port() == "" {
+			hostport = fmt.Sprintf("%s:%d", c.url.Host, 443)
 		}
 
 		log.Tracef("establishing tls conn on: %v", hostport)
-		tlsconn, err := tls.DialWithDialer(dialer, "tcp", hostport, &tls.Config{
-			InsecureSkipVerify: true,
-		})
+		start := time.Now()
+		raw, err := c.DialContext(ctx, "tcp", hostport)
+		timings.Dial = time.Since(start)
 		if err != nil {
-			return nil, errors.Wrap(err, "Failed to dial tls")
+			return nil, upgradeError(ctx, dialErrorKind(err), errors.Wrap(err, "Failed to dial tls"))
+		}
+		tlsconn := tls.Client(raw, c.TLSConfig())
+		start = time.Now()
+		err = withDeadline(ctx, raw, c.timeouts.TLSHandshake, tlsconn.Handshake)
+		timings.TLSHandshake = time.Since(start)
+		if err != nil {
+			raw.Close()
+			return nil, upgradeError(ctx, KindTLS, errors.Wrap(err, "Failed to dial tls"))
 		}
 		ret = tlsconn
 	case "http":
-		hostport := t.Host
-		if t.Port() == "" {
-			hostport = fmt.Sprintf("%s:%d", t.Host, 80)
+		hostport := c.url.Host
+		if c.url.Port() == "" {
+			hostport = fmt.Sprintf("%s:%d", c.url.Host, 80)
 		}
 		log.Tracef("establishing tcp conn on: %v", hostport)
-		ret, err = dialer.Dial("tcp", hostport)
+		start := time.Now()
+		ret, err = c.DialContext(ctx, "tcp", hostport)
+		timings.Dial = time.Since(start)
 		if err != nil {
-			return nil, errors.Wrap(err, "Failed to dial tcp")
+			return nil, upgradeError(ctx, dialErrorKind(err), errors.Wrap(err, "Failed to dial tcp"))
 		}
 	default:
 		return nil, ErrUnexpectedScheme
@@ -220,10 +489,104 @@ func CreateConn(t *url.URL, dialer *net.Dialer) (ret net.Conn, err error) {
 	return
 }
 
+// withDeadline will run fn with the conn deadline set to the timeout. If ctx is cancelled
+// while fn is running, the conn deadline is expired to abort any pending io. The deadline is
+// cleared once fn returns
+func withDeadline(ctx context.Context, conn net.Conn, timeout time.Duration, fn func() error) error {
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	conn.SetDeadline(time.Time{})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// roundTrip will perform the request with fn, enforcing the response timeout from when
+// the request has been written until the response headers are received
+func (c *Conn) roundTrip(req *http.Request, fn func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
+	return c.roundTripTimeout(req, c.timeouts.Response, fn)
+}
+
+// roundTripTimeout will perform the request with fn, enforcing the timeout from when the
+// request has been written until the response headers are received
+func (c *Conn) roundTripTimeout(req *http.Request, timeout time.Duration, fn func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
+	if timeout == 0 {
+		return fn(req)
+	}
+
+	var (
+		mu       sync.Mutex
+		timer    *time.Timer
+		done     bool
+		timedOut int32
+	)
+	ctx, cancel := context.WithCancel(req.Context())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if done || timer != nil {
+				return
+			}
+			timer = time.AfterFunc(timeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				cancel()
+			})
+		},
+	})
+
+	res, err := fn(req.WithContext(ctx))
+	mu.Lock()
+	done = true
+	if timer != nil {
+		timer.Stop()
+	}
+	mu.Unlock()
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		cancel()
+		if res != nil {
+			res.Body.Close()
+		}
+		return nil, ErrResponseTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody releases the request context once the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 // doUpgrade will attempt to establish a TCP connection and perform the Upgrade Request
 // This will then recieve the response from the upgraded request and return it to the caller
 // This may fail due to unexpected EOF, hence retries are handled at DoUpgrade
-func (c *Conn) doUpgrade(req *http.Request) (*http.Response, error) {
+// If raw is set, it is written as the upgrade request in place of req
+func (c *Conn) doUpgrade(ctx context.Context, req *http.Request, raw []byte) (*http.Response, error) {
 	log.Tracef("starting doUpgrade internal")
 	var err error
 	log.Tracef("establishing tcp conn")
@@ -231,14 +594,80 @@ func (c *Conn) doUpgrade(req *http.Request) (*http.Response, error) {
 		"headers": req.Header,
 	}).Tracef("performing upgrade request")
 
-	c.conn, err = CreateConn(c.url, c.dialer)
+	rec := newUpgradeRecorder()
+	defer func() {
+		c.setUpgradeResult(rec.finish())
+	}()
+
+	c.conn, err = c.createConn(ctx, &rec.result.Timings)
 	if err != nil {
 		return nil, errors.Wrap(err, "h2csmuggler: connection failed")
 	}
+	rec.connected(c.conn)
+	req = rec.trace(req)
+
+	if c.priorKnowledge {
+		return c.doPriorKnowledge(ctx, req, rec)
+	}
+
+	upgradeCtx := ctx
+	if c.timeouts.Upgrade != 0 {
+		var cancel context.CancelFunc
+		upgradeCtx, cancel = context.WithTimeout(ctx, c.timeouts.Upgrade)
+		defer cancel()
+	}
+
+	res, err := c.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		var (
+			cc  *http2.ClientConn
+			res *http.Response
+			err error
+		)
+		if raw != nil {
+			cc, res, err = c.transport.H2CUpgradeRawRequestContext(upgradeCtx, raw, req, c.conn)
+		} else {
+			cc, res, err = c.transport.H2CUpgradeRequestContext(upgradeCtx, req, c.conn)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.h2c = cc
+		return res, nil
+	})
+	if err != nil {
+		if c.h2c != nil {
+			c.h2c.Close()
+			c.h2c = nil
+		}
+		return nil, upgradeError(ctx, responseErrorKind(err, &rec.info, false), errors.Wrap(err, "h2csmuggler: upgrade failed"))
+	}
+	c.setInitialized()
+	return res, nil
+}
+
+// doPriorKnowledge will start the http2 connection by sending the client preface directly,
+// rather than upgrading from HTTP/1.1. The request is then sent as stream 1. Since there is
+// no upgrade response, the upgrade timeout bounds the first response instead
+// The server's SETTINGS are recorded into rec
+func (c *Conn) doPriorKnowledge(ctx context.Context, req *http.Request, rec *upgradeRecorder) (*http.Response, error) {
+	log.Tracef("sending prior knowledge preface")
+	cc, err := c.transport.NewClientConn(c.conn)
+	if err != nil {
+		return nil, upgradeError(ctx, KindOther, errors.Wrap(err, "h2csmuggler: prior knowledge failed"))
+	}
 
-	cc, res, err := c.transport.H2CUpgradeRequest(req, c.conn)
+	timeout := c.timeouts.Upgrade
+	if timeout == 0 {
+		timeout = http2.DefaultH2CTimeout
+	}
+	res, err := c.roundTripTimeout(req, timeout, cc.RoundTrip)
+	rec.info.ServerSettings, _ = cc.ServerSettings()
 	if err != nil {
-		return nil, errors.Wrap(err, "h2csmuggler: upgrade failed")
+		if goAway, ok := cc.GoAway(); ok {
+			err = goAway
+		}
+		cc.Close()
+		return nil, upgradeError(ctx, responseErrorKind(err, &rec.info, true), errors.Wrap(err, "h2csmuggler: prior knowledge failed"))
 	}
 	c.h2c = cc
 	c.setInitialized()
@@ -251,58 +680,77 @@ func (c *Conn) doUpgrade(req *http.Request) (*http.Response, error) {
 // will be returned (e.g. timeout, HTTP2 not supported etc...)
 // The provided request will have the following headers added to ensure the upgrade occurs.
 // Upgrade: h2c
-// HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA
-// Connection: Upgrade
+// HTTP2-Settings: <the connection's settings, see ConnectionSettings>
+// Connection: Upgrade, HTTP2-Settings
 // These can be modified with the upgrade options however this may result in an unsuccessful connection
-// TODO: make this threadsafe.
+// If the upgrade fails, the error is an *UpgradeError classifying the failure
 func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
-	log.Tracef("starting upgrade")
+	return c.DoUpgradeContext(req.Context(), req, opts...)
+}
+
+// DoUpgradeContext is like DoUpgrade, however ctx bounds the dial, the upgrade and the
+// first response. Cancelling ctx will abort whichever phase is currently running
+func (c *Conn) DoUpgradeContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
+	if err := c.lockUpgrade(ctx); err != nil {
+		return nil, err
+	}
+	defer c.unlockUpgrade()
 	if c.Initialized() {
 		return nil, errors.New("h2csmuggler: already initialized")
 	}
+	return c.upgrade(ctx, req, opts...)
+}
 
-	o := &UpgradeOptions{
-		HTTP2SettingsHeader: DefaultHTTP2SettingsHeader,
-		ConnectionHeader:    DefaultConnectionHeader,
-		UpgradeHeader:       DefaultUpgradeHeader,
-	}
-	for _, opt := range opts {
-		opt(o)
+// upgrade will perform the upgrade with the request. The upgrade lock must be held
+func (c *Conn) upgrade(ctx context.Context, req *http.Request, opts ...UpgradeOption) (res *http.Response, err error) {
+	log.Tracef("starting upgrade")
+	defer func() { c.observe(res, err) }()
+
+	o := newUpgradeOptions(append(append([]UpgradeOption{}, c.upgradeOpts...), opts...)...)
+	if o.HTTP2SettingsHeader == "" {
+		o.HTTP2SettingsHeader = http2.EncodeSettings(c.transport.InitialSettings())
 	}
 
 	// Clone to avoid corrupting the request after we add our headers
-	req = req.Clone(req.Context())
-	if o.UpgradeHeaderDisabled {
-		req.Header.Del("Upgrade")
-	} else {
-		req.Header.Add("Upgrade", o.UpgradeHeader)
-	}
+	req = req.Clone(ctx)
 
-	if o.ConnectionHeaderDisabled {
-		req.Header.Del("Connnection")
-	} else {
-		req.Header.Add("Connection", o.ConnectionHeader)
+	var raw []byte
+	if o.Raw != nil && !c.priorKnowledge {
+		raw, err = o.Raw.Render(req, o)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if o.HTTP2SettingsHeaderDisabled {
-		req.Header.Del("HTTP2-Settings")
-	} else {
-		req.Header.Add("HTTP2-Settings", o.HTTP2SettingsHeader)
-	}
+	// with prior knowledge there's no upgrade, so the request is sent as is
+	if !c.priorKnowledge && raw == nil {
+		if o.UpgradeHeaderDisabled {
+			req.Header.Del("Upgrade")
+		} else {
+			req.Header.Add("Upgrade", o.UpgradeHeader)
+		}
 
-	var (
-		res *http.Response
-		err error
-	)
+		if o.ConnectionHeaderDisabled {
+			req.Header.Del("Connection")
+		} else {
+			req.Header.Add("Connection", o.ConnectionHeader)
+		}
+
+		if o.HTTP2SettingsHeaderDisabled {
+			req.Header.Del("HTTP2-Settings")
+		} else {
+			req.Header.Add("HTTP2-Settings", o.HTTP2SettingsHeader)
+		}
+	}
 
 	for i := 0; i < c.maxRetries+1; i++ {
 		log.Tracef("attempt: %d/%d", i, c.maxRetries+1)
-		res, err = c.doUpgrade(req)
+		res, err = c.doUpgrade(ctx, req, raw)
 		if err == nil {
 			break
 		}
 		if err != nil {
-			if !errors.Is(err, io.ErrUnexpectedEOF) {
+			if !errors.Is(err, io.ErrUnexpectedEOF) || ctx.Err() != nil {
 				log.WithError(err).Tracef("recieved error")
 				return nil, err
 			} else {
@@ -312,6 +760,13 @@ func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Respon
 		if c.conn != nil {
 			c.conn.Close()
 		}
+
+		// the body was consumed by the failed attempt
+		var rerr error
+		req, rerr = rewindRequest(req)
+		if rerr != nil {
+			return nil, errors.Wrap(rerr, "h2csmuggler: rewind request")
+		}
 	}
 	if err != nil {
 		return nil, err
@@ -320,10 +775,56 @@ func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Respon
 	return res, nil
 }
 
+// Do will perform the request over the h2c connection, upgrading the connection with the
+// request if it has not been initialized. The request context is used for all phases
 func (c *Conn) Do(req *http.Request) (*http.Response, error) {
+	return c.DoContext(req.Context(), req)
+}
+
+// DoContext is like Do, however ctx is used in place of the request context.
+func (c *Conn) DoContext(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return c.doContext(ctx, req)
+}
+
+// doContext will perform the request, upgrading the connection with the request and opts if it
+// has not been initialized
+func (c *Conn) doContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
 	if !c.Initialized() {
-		return c.DoUpgrade(req)
+		if err := c.lockUpgrade(ctx); err != nil {
+			return nil, err
+		}
+		// another caller may have upgraded the connection while we waited
+		if !c.Initialized() {
+			defer c.unlockUpgrade()
+			return c.upgrade(ctx, req, opts...)
+		}
+		c.unlockUpgrade()
+	}
+
+	return c.observe(c.roundTrip(req.WithContext(ctx), c.h2c.RoundTrip))
+}
+
+// observe will pass the response to the connection's response observer, if any
+func (c *Conn) observe(res *http.Response, err error) (*http.Response, error) {
+	if c.responseObserver != nil {
+		c.responseObserver(res, err)
 	}
+	return res, err
+}
 
-	return c.h2c.RoundTrip(req)
+// rewindRequest will return a copy of req which can be sent again
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("h2csmuggler: request body cannot be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	return retry, nil
 }
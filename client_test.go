@@ -0,0 +1,727 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
+	"github.com/pkg/errors"
+)
+
+// startH2CServer will start a http server which accepts h2c upgrades for the handler
+func startH2CServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+}
+
+// countConns will count the connections accepted by the server
+func countConns(s *httptest.Server, conns *int32) {
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+}
+
+// startSilentServer will start a tcp listener which accepts connections and never responds
+func startSilentServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ioutil.ReadAll(c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestConnDo(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto + " " + r.URL.Path))
+	})
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, path := range []string{"/upgrade", "/smuggled"} {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(body), "HTTP/2.0 "+path; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+	}
+}
+
+func TestConnUpgradeTimeout(t *testing.T) {
+	l := startSilentServer(t)
+	defer l.Close()
+
+	c, err := NewConn("http://"+l.Addr().String(), ConnectionTimeouts(Timeouts{
+		Upgrade: 100 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = c.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got err %v, want deadline exceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("upgrade took %v, want ~100ms", d)
+	}
+}
+
+func TestConnDoContextCancel(t *testing.T) {
+	l := startSilentServer(t)
+	defer l.Close()
+
+	c, err := NewConn("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = c.DoContext(ctx, req)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got err %v, want context canceled", err)
+	}
+}
+
+func TestConnResponseTimeout(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+	})
+	defer s.Close()
+
+	c, err := NewConn(s.URL, ConnectionTimeouts(Timeouts{
+		Response: 100 * time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req, err = http.NewRequest("GET", s.URL+"/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	if err != ErrResponseTimeout {
+		t.Fatalf("got err %v, want %v", err, ErrResponseTimeout)
+	}
+}
+
+func TestConnPriorKnowledge(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	defer s.Close()
+
+	c, err := NewConn(s.URL, ConnectionPriorKnowledge(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(body), "HTTP/2.0"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+	}
+}
+
+func TestConnPriorKnowledgeUnsupported(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	c, err := NewConn(s.URL, ConnectionPriorKnowledge(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("expected prior knowledge to fail against a HTTP/1.1 server")
+	}
+}
+
+func TestConnConcurrentDo(t *testing.T) {
+	const maxStreams = 2
+	var (
+		conns       int32
+		inflight    int32
+		maxInflight int32
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInflight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInflight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	})
+	s := httptest.NewUnstartedServer(h2c.NewHandler(h, &http2.Server{MaxConcurrentStreams: maxStreams}))
+	countConns(s, &conns)
+	s.Start()
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res, err := c.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+	if got := atomic.LoadInt32(&maxInflight); got > maxStreams {
+		t.Errorf("got %d concurrent streams, want at most %d", got, maxStreams)
+	}
+}
+
+func TestConnUpgradeBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(r *http.Request)
+	}{
+		{"content-length", func(r *http.Request) {}},
+		{"chunked", func(r *http.Request) { r.TransferEncoding = []string{"chunked"} }},
+		{"expect-continue", func(r *http.Request) { r.Header.Set("Expect", "100-continue") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the h2c handler doesn't consume the upgrade body, so read it before upgrading
+			bodies := make(chan string, 1)
+			h2cHandler := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			}), &http2.Server{})
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				bodies <- string(b)
+				h2cHandler.ServeHTTP(w, r)
+			}))
+			defer s.Close()
+
+			c, err := NewConn(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req, err := http.NewRequest("POST", s.URL, strings.NewReader("upgrade body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.mutate(req)
+
+			start := time.Now()
+			res, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("got body %q, want HTTP/2.0", body)
+			}
+			if got := <-bodies; got != "upgrade body" {
+				t.Errorf("server got upgrade body %q", got)
+			}
+			// the body should be sent on the 100 Continue, rather than the timeout
+			if d := time.Since(start); d > http2.DefaultExpectContinueTimeout/2 {
+				t.Errorf("upgrade took %v", d)
+			}
+		})
+	}
+}
+
+// recordedSettings will return the settings sent in the HTTP2-Settings header and the
+// SETTINGS frame of the client preface, from the bytes read by the server
+func recordedSettings(t *testing.T, raw []byte) (header []http2.Setting, preface []http2.Setting) {
+	t.Helper()
+	i := bytes.Index(raw, []byte(http2.ClientPreface))
+	if i < 0 {
+		t.Fatalf("no client preface in %q", raw)
+	}
+	for _, line := range strings.Split(string(raw[:i]), "\r\n") {
+		if v := strings.TrimPrefix(line, "Http2-Settings: "); v != line {
+			var err error
+			if header, err = http2.DecodeSettings(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fr := http2.NewFramer(nil, bytes.NewReader(raw[i+len(http2.ClientPreface):]))
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("got %v after the preface, want SETTINGS", f)
+	}
+	sf.ForeachSetting(func(s http2.Setting) error {
+		preface = append(preface, s)
+		return nil
+	})
+	return header, preface
+}
+
+func TestConnectionSettings(t *testing.T) {
+	settings := []http2.Setting{
+		{ID: http2.SettingEnablePush, Val: 0},
+		{ID: http2.SettingInitialWindowSize, Val: 1 << 16},
+		{ID: 0x8, Val: 1},
+	}
+	tests := []struct {
+		name       string
+		opts       []UpgradeOption
+		wantHeader []http2.Setting
+	}{
+		{name: "matching", wantHeader: settings},
+		{
+			name:       "mismatched",
+			opts:       []UpgradeOption{SetHTTP2Settings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 7})},
+			wantHeader: []http2.Setting{{ID: http2.SettingMaxConcurrentStreams, Val: 7}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat("a", 1<<17)))
+			}), &http2.Server{}))
+			l := &recordingListener{Listener: s.Listener}
+			s.Listener = l
+			s.Start()
+			defer s.Close()
+
+			c, err := NewConn(s.URL, ConnectionSettings(settings...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req, err := http.NewRequest("GET", s.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := c.DoUpgrade(req, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// larger than the advertised window, so the window must be refreshed
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil || len(body) != 1<<17 {
+				t.Fatalf("got %d bytes, err %v", len(body), err)
+			}
+
+			header, preface := recordedSettings(t, l.Bytes())
+			if !reflect.DeepEqual(header, tt.wantHeader) {
+				t.Errorf("got HTTP2-Settings %v, want %v", header, tt.wantHeader)
+			}
+			if !reflect.DeepEqual(preface, settings) {
+				t.Errorf("got preface settings %v, want %v", preface, settings)
+			}
+		})
+	}
+}
+
+func TestConnDefaultSettings(t *testing.T) {
+	s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &http2.Server{}))
+	l := &recordingListener{Listener: s.Listener}
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.DoUpgrade(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	header, preface := recordedSettings(t, l.Bytes())
+	if !reflect.DeepEqual(header, preface) {
+		t.Errorf("got HTTP2-Settings %v, want the preface settings %v", header, preface)
+	}
+	if DefaultTransport.Settings != nil {
+		t.Errorf("DefaultTransport was modified")
+	}
+}
+
+func TestConnectionFrameObserver(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	defer s.Close()
+
+	var (
+		mu      sync.Mutex
+		events  []http2.FrameEvent
+		targets []string
+	)
+	observer := func(target *url.URL) http2.FrameObserver {
+		targets = append(targets, target.String())
+		return http2.FrameObserverFunc(func(e http2.FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			e.Frame = nil // only valid during the call
+			events = append(events, e)
+		})
+	}
+
+	c, err := NewConn(s.URL, ConnectionFrameObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, path := range []string{"/upgrade", "/first", "/second"} {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	if len(targets) != 1 || targets[0] != s.URL {
+		t.Errorf("got observer targets %v, want %v", targets, s.URL)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var sentPaths, recvStatus []string
+	for _, e := range events {
+		for _, hf := range e.Headers {
+			switch {
+			case e.Direction == http2.FrameSent && hf.Name == ":path":
+				sentPaths = append(sentPaths, hf.Value)
+			case e.Direction == http2.FrameReceived && hf.Name == ":status":
+				recvStatus = append(recvStatus, hf.Value)
+			}
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event without a timestamp: %v", e)
+		}
+	}
+	// the upgrade request is sent over HTTP/1.1, so has no HEADERS frame
+	if want := []string{"/first", "/second"}; !reflect.DeepEqual(sentPaths, want) {
+		t.Errorf("got sent paths %v, want %v", sentPaths, want)
+	}
+	if want := []string{"200", "200", "200"}; !reflect.DeepEqual(recvStatus, want) {
+		t.Errorf("got received statuses %v, want %v", recvStatus, want)
+	}
+}
+
+func TestConnectionPushHandler(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/push":
+			if p, ok := w.(http.Pusher); ok {
+				if err := p.Push("/pushed?a=b", &http.PushOptions{Header: http.Header{"X-Push": {"1"}}}); err != nil {
+					t.Errorf("push failed: %v", err)
+				}
+			}
+			w.Write([]byte("pusher"))
+		case "/pushed":
+			w.Write([]byte("secret"))
+		}
+	})
+	defer s.Close()
+
+	type pushed struct {
+		push *http2.PushPromise
+		body string
+		err  error
+	}
+	pushes := make(chan pushed, 1)
+	h := http2.PushHandlerFunc(func(push *http2.PushPromise, res *http.Response, err error) {
+		p := pushed{push: push, err: err}
+		if err == nil {
+			b, _ := ioutil.ReadAll(res.Body)
+			p.body = string(b)
+		}
+		pushes <- p
+	})
+
+	c, err := NewConn(s.URL, ConnectionPushHandler(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, path := range []string{"/", "/push"} {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	select {
+	case p := <-pushes:
+		if p.err != nil {
+			t.Fatal(p.err)
+		}
+		if got := p.push.Request.URL.RequestURI(); got != "/pushed?a=b" {
+			t.Errorf("got pushed request %q, want /pushed?a=b", got)
+		}
+		if got := p.push.Request.Header.Get("X-Push"); got != "1" {
+			t.Errorf("got pushed header %q, want 1", got)
+		}
+		if p.push.Associated == nil || p.push.Associated.URL.Path != "/push" {
+			t.Errorf("got associated request %v, want /push", p.push.Associated)
+		}
+		if p.body != "secret" {
+			t.Errorf("got pushed body %q, want secret", p.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the push")
+	}
+}
+
+// limiterFunc adapts a function to a Limiter
+type limiterFunc func(ctx context.Context) error
+
+func (f limiterFunc) Wait(ctx context.Context) error { return f(ctx) }
+
+func TestConnectionLimiter(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	var waits int32
+	c, err := NewConn(s.URL, ConnectionLimiter(limiterFunc(func(ctx context.Context) error {
+		atomic.AddInt32(&waits, 1)
+		return nil
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&waits); got != 1 {
+		t.Errorf("got %d waits, want 1 for the upgrade", got)
+	}
+
+	denied := errors.New("denied")
+	c, err = NewConn(s.URL, ConnectionMaxRetries(0), ConnectionLimiter(limiterFunc(func(ctx context.Context) error {
+		return denied
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); !errors.Is(err, denied) {
+		t.Errorf("got err %v, want the limiter's error", err)
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("got %d connections, want none dialed after the limiter failed", got)
+	}
+}
+
+func TestConnUpgradeRewindFailure(t *testing.T) {
+	// close each connection without responding, so the upgrade is retried
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	c, err := NewConn("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the body can't be replayed without GetBody
+	req, err := http.NewRequest("POST", "http://"+l.Addr().String(), ioutil.NopCloser(strings.NewReader("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	if err == nil || !strings.Contains(err.Error(), "rewind request") {
+		t.Errorf("got error %v, want the rewind failure", err)
+	}
+}
+
+func TestConnectionResponseObserver(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/busy" {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	defer s.Close()
+
+	var statuses []string
+	observer := func(res *http.Response, err error) {
+		if err != nil {
+			statuses = append(statuses, err.Error())
+			return
+		}
+		statuses = append(statuses, res.Status+" "+res.Header.Get("Retry-After"))
+	}
+
+	c, err := NewConn(s.URL, ConnectionResponseObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, path := range []string{"/upgrade", "/busy"} {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(res.Body); string(b) != path {
+			t.Errorf("got body %q, want %q", b, path)
+		}
+		res.Body.Close()
+	}
+
+	want := []string{"200 OK ", "503 Service Unavailable 1"}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got observed %q, want %q", statuses, want)
+	}
+}
@@ -1,9 +1,6 @@
 package cmd
 
 import (
-	"bufio"
-	"os"
-
 	"github.com/assetnote/h2csmuggler/pkg/parallel"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -12,6 +9,10 @@ import (
 var (
 	concurrency = 5
 	infile      = ""
+
+	checkPriorKnowledge = false
+	checkMatrix         = false
+	checkNoBatch        = false
 )
 
 // checkCmd represents the check command
@@ -24,43 +25,33 @@ over http2 and the results are compared
 
 use "-" as first argument to recieve from stdin.
 If infile is specified, then that will override CLI arguments.
-Each target will have a separate connection opened. There is no optimization for batching paths to same host:port combinations`,
+Targets with the same scheme, host and port share a connection. The first target
+upgrades it, and the other targets are sent as additional streams once it works.
+Targets which can't use the shared connection are retried on a connection of their own`,
 	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) == 0 {
-				log.Fatalf("no infile specified and no arguments provided.")
-			}
-			if args[0] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args
-			}
+		if infile == "" && len(args) == 0 {
+			log.Fatalf("no infile specified and no arguments provided.")
 		}
+		lines := readLines(infile, args)
 
 		c := parallel.New()
+		c.ConnectionOptions = connectionOptions()
+		c.PriorKnowledge = checkPriorKnowledge
+		c.DisableBatching = checkNoBatch
 		c.MaxParallelHosts = concurrency
-		err := c.GetParallelHosts(lines)
+		c.ResultHandler = parallel.LogHostResults()
+		c.MatrixHandler = parallel.LogMatrix()
+		configureTechnique(c)
+		configureRateLimits(c)
+		configureCheckpoint(c)
+		defer c.Checkpoint.Close()
+		var err error
+		if checkMatrix {
+			err = c.GetUpgradeMatrixStream(lines)
+		} else {
+			err = c.GetParallelHostsStream(lines)
+		}
 		if err != nil {
 			log.WithError(err).Errorf("failed")
 		}
@@ -80,5 +71,12 @@ func init() {
 	// is called directly, e.g.:
 	checkCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
 	checkCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read from")
+	checkCmd.Flags().BoolVar(&checkPriorKnowledge, "prior-knowledge", false, "additionally check whether h2c with prior knowledge works. This is reported separately from the upgrade. Only applies to the h2c technique")
+	checkCmd.Flags().BoolVar(&checkMatrix, "matrix", false, "try a matrix of h2c upgrade header variants against each target, reporting which variants produce a 101 and a response on stream 1")
+	checkCmd.Flags().BoolVar(&checkNoBatch, "no-batch", false, "upgrade a separate connection for every target, instead of sharing a connection between the targets of each origin")
+	addConnectionFlags(checkCmd)
+	addTechniqueFlags(checkCmd)
+	addRateLimitFlags(checkCmd)
+	addStateFlags(checkCmd)
 
 }
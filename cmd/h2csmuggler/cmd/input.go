@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/assetnote/h2csmuggler/pkg/parallel"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stateFile = ""
+	resume    = false
+)
+
+// readLines will return a channel of the lines of infile if it is set, otherwise the lines of
+// stdin if the first of args is "-", otherwise args. Lines are read as they are consumed, so
+// large inputs are not held in memory. The channel is closed once the input is exhausted
+func readLines(infile string, args []string) <-chan string {
+	lines := make(chan string)
+	var r io.ReadCloser
+	switch {
+	case infile != "":
+		log.WithField("filename", infile).Debugf("loading from infile")
+		file, err := os.Open(infile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r = file
+	case len(args) > 0 && args[0] == "-":
+		r = os.Stdin
+	default:
+		return parallel.Targets(args)
+	}
+
+	go func() {
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+// addStateFlags will register the flags used to record progress and resume a run
+func addStateFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&stateFile, "state", "", "file to record each completed target and its result to, as json lines")
+	cmd.Flags().BoolVar(&resume, "resume", false, "skip the targets recorded in the state file by a previous run, appending to it instead of starting over. Targets which failed to connect or timed out are retried")
+}
+
+// configureCheckpoint will open the state file as the checkpoint of c, if one was provided.
+// The checkpoint must be closed once the run completes
+func configureCheckpoint(c *parallel.Client) {
+	if stateFile == "" {
+		if resume {
+			log.Fatalf("--resume requires --state")
+		}
+		return
+	}
+	cp, err := parallel.OpenCheckpoint(stateFile, resume)
+	if err != nil {
+		log.WithError(err).Fatalf("failed to open state file")
+	}
+	c.Checkpoint = cp
+}
@@ -1,9 +1,7 @@
 package cmd
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 
 	"github.com/assetnote/h2csmuggler/pkg/paths"
 	log "github.com/sirupsen/logrus"
@@ -26,49 +24,36 @@ You can use '-' as the second argument to pipe from stdin
 you can use infile flag to specify a file to take in as the paths`,
 	Run: func(cmd *cobra.Command, args []string) {
 		base := args[0]
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) < 2 {
-				log.Fatalf("no infile specified and no targets provided.")
-			}
-			if args[1] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args[1:]
-			}
+		if infile == "" && len(args) < 2 {
+			log.Fatalf("no infile specified and no targets provided.")
 		}
 
-		lines = append(lines, paths.Prefix(prefix, lines)...)
-		res, err := paths.Pitchfork(base, lines)
-		if err != nil {
-			log.WithError(err).Fatalf("failed to mutate")
-		}
-		for _, l := range res {
-			fmt.Println(l)
+		// the paths are written out as soon as they are read, so the output can be piped into
+		// smuggle without waiting for the whole input. The prefixed paths follow once the
+		// input is exhausted, so only the paths are held in memory, and only with prefixes
+		var lines []string
+		for line := range readLines(infile, args[1:]) {
+			if len(prefix) > 0 {
+				lines = append(lines, line)
+			}
+			printPitchfork(base, []string{line})
 		}
+		printPitchfork(base, paths.Prefix(prefix, lines))
 
 	},
 }
 
+// printPitchfork will print the urls of the paths on the base
+func printPitchfork(base string, lines []string) {
+	res, err := paths.Pitchfork(base, lines)
+	if err != nil {
+		log.WithError(err).Fatalf("failed to mutate")
+	}
+	for _, l := range res {
+		fmt.Println(l)
+	}
+}
+
 func init() {
 	mutateCmd.AddCommand(pitchforkCmd)
 
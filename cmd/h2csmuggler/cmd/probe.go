@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"github.com/assetnote/h2csmuggler"
+	"github.com/assetnote/h2csmuggler/pkg/parallel"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	desyncTechniques = []string{}
+	desyncMethod     = "POST"
+	desyncTimeout    = h2csmuggler.DefaultDesyncTimeout
+)
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Probe the hops behind a h2c tunnel",
+}
+
+var probeDesyncCmd = &cobra.Command{
+	Use:   "desync <targets>...",
+	Short: "Check whether the hop behind the h2c tunnel can be desynchronised",
+	Long: `This upgrades a connection to each target, then sends H2.CL and H2.TE style requests
+through the tunnel. These declare a content-length which doesn't match the DATA frames, or a
+transfer-encoding: chunked body. If the h2c backend downgrades to HTTP/1.1 and trusts these
+headers, a probe declaring more body than is sent will hang until the timeout, and a probe
+sending more body than is declared will change the response to the next request
+
+use "-" as first argument to recieve from stdin.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var techniques []h2csmuggler.DesyncTechnique
+		for _, t := range desyncTechniques {
+			technique, err := h2csmuggler.ParseDesyncTechnique(t)
+			if err != nil {
+				log.WithError(err).Fatalf("failed to parse desync technique")
+			}
+			techniques = append(techniques, technique)
+		}
+
+		c := parallel.New()
+		c.ConnectionOptions = connectionOptions()
+		c.MaxParallelHosts = concurrency
+		c.DesyncTechniques = techniques
+		c.DesyncHandler = parallel.LogDesync()
+		configureRateLimits(c)
+		c.DesyncOptions = []h2csmuggler.DesyncOption{
+			h2csmuggler.DesyncMethod(desyncMethod),
+			h2csmuggler.DesyncTimeout(desyncTimeout),
+		}
+		if err := c.ProbeDesyncStream(readLines("", args)); err != nil {
+			log.WithError(err).Errorf("failed")
+		}
+	},
+}
+
+func init() {
+	probeDesyncCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
+	probeDesyncCmd.Flags().StringArrayVar(&desyncTechniques, "desync-technique", nil, "desync technique to try, H2.CL or H2.TE. Can be repeated. Defaults to both")
+	probeDesyncCmd.Flags().StringVarP(&desyncMethod, "method", "X", "POST", "method of the probes")
+	probeDesyncCmd.Flags().DurationVar(&desyncTimeout, "timeout", h2csmuggler.DefaultDesyncTimeout, "how long to wait for a response before the hop is considered to be waiting for more body")
+	addConnectionFlags(probeDesyncCmd)
+	addRateLimitFlags(probeDesyncCmd)
+
+	probeCmd.AddCommand(probeDesyncCmd)
+	rootCmd.AddCommand(probeCmd)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// settingsCmd represents the settings command
+var settingsCmd = &cobra.Command{
+	Use:   "settings",
+	Short: "Convert http2 settings to and from the HTTP2-Settings header",
+	Long: `The HTTP2-Settings header of a h2c upgrade carries the client's SETTINGS as
+base64url. These commands convert between the header value and readable settings`,
+}
+
+var settingsEncodeCmd = &cobra.Command{
+	Use:   "encode <ID=VALUE>...",
+	Short: "Encode settings as a HTTP2-Settings header value",
+	Long: `Settings are given as ID=VALUE, where ID is the setting name or its numeric identifier
+e.g. h2csmuggler settings encode ENABLE_PUSH=0 INITIAL_WINDOW_SIZE=65535 0x8=1
+Values are not validated, and settings are encoded in the order given`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		settings, err := parseSettings(args)
+		if err != nil {
+			log.WithError(err).Fatalf("failed to parse settings")
+		}
+		fmt.Println(http2.EncodeSettings(settings))
+	},
+}
+
+var settingsDecodeCmd = &cobra.Command{
+	Use:   "decode <value>",
+	Short: "Decode a HTTP2-Settings header value",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		settings, err := http2.DecodeSettings(args[0])
+		if err != nil {
+			log.WithError(err).Fatalf("failed to decode settings")
+		}
+
+		if output == "json" {
+			type setting struct {
+				ID    uint16 `json:"id"`
+				Name  string `json:"name"`
+				Value uint32 `json:"value"`
+				Valid bool   `json:"valid"`
+			}
+			ret := make([]setting, 0, len(settings))
+			for _, s := range settings {
+				ret = append(ret, setting{ID: uint16(s.ID), Name: s.ID.String(), Value: s.Val, Valid: s.Valid() == nil})
+			}
+			b, err := json.Marshal(ret)
+			if err != nil {
+				log.WithError(err).Fatalf("failed to marshal settings")
+			}
+			fmt.Println(string(b))
+			return
+		}
+
+		for _, s := range settings {
+			if err := s.Valid(); err != nil {
+				fmt.Printf("%v=%d (invalid: %v)\n", s.ID, s.Val, err)
+				continue
+			}
+			fmt.Printf("%v=%d\n", s.ID, s.Val)
+		}
+	},
+}
+
+// parseSettings will parse each ID=VALUE setting
+func parseSettings(args []string) ([]http2.Setting, error) {
+	settings := make([]http2.Setting, 0, len(args))
+	for _, a := range args {
+		s, err := http2.ParseSetting(a)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func init() {
+	settingsCmd.AddCommand(settingsEncodeCmd)
+	settingsCmd.AddCommand(settingsDecodeCmd)
+	rootCmd.AddCommand(settingsCmd)
+}
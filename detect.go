@@ -0,0 +1,130 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpgradeVariant is a named set of upgrade options. Proxies differ in which forms of the
+// upgrade headers they forward, so trying several variants finds more smuggling vectors
+type UpgradeVariant struct {
+	Name        string
+	Description string
+	Options     []UpgradeOption
+}
+
+// DefaultUpgradeVariants is the curated set of variants tried by DetectUpgrade
+var DefaultUpgradeVariants = []UpgradeVariant{
+	{
+		Name:        "standard",
+		Description: "spec compliant upgrade. Connection: Upgrade, HTTP2-Settings",
+	},
+	{
+		Name:        "connection-upgrade-only",
+		Description: "Connection: Upgrade, with HTTP2-Settings sent but not listed as hop-by-hop",
+		Options:     []UpgradeOption{SetConnectionHeader("Upgrade")},
+	},
+	{
+		Name:        "no-http2-settings",
+		Description: "Connection: Upgrade, without the HTTP2-Settings header",
+		Options: []UpgradeOption{
+			SetConnectionHeader("Upgrade"),
+			DisableHTTP2SettingsHeader(true),
+		},
+	},
+	{
+		Name:        "no-connection",
+		Description: "no Connection header, relying on the proxy to add it",
+		Options:     []UpgradeOption{DisableConnectionHeader(true)},
+	},
+	{
+		Name:        "uppercase-token",
+		Description: "Upgrade: H2C",
+		Options:     []UpgradeOption{SetUpgradeHeader("H2C")},
+	},
+	{
+		Name:        "lowercase-connection",
+		Description: "Connection: upgrade, http2-settings",
+		Options:     []UpgradeOption{SetConnectionHeader("upgrade, http2-settings")},
+	},
+	{
+		Name:        "h2c-14",
+		Description: "Upgrade: h2c-14, the token from draft 14 of the http2 spec",
+		Options:     []UpgradeOption{SetUpgradeHeader("h2c-14")},
+	},
+}
+
+// UpgradeVariantResult is the outcome of upgrading a connection with a single variant
+type UpgradeVariantResult struct {
+	Variant UpgradeVariant
+
+	Upgraded   bool // the server responded with 101 Switching Protocols
+	Stream1    bool // the response to the upgrade request was received over http2 on stream 1
+	StatusCode int  // status of the stream 1 response, or of the upgrade response if not upgraded
+	Err        error
+
+	Result *UpgradeResult // details of the upgrade attempt
+}
+
+// DetectUpgrade will attempt to upgrade a new connection to target with each variant, and
+// report which variants produced a 101 and a working stream 1. If variants is nil,
+// DefaultUpgradeVariants is used. Variants are tried sequentially, each on a fresh connection
+// created with opts. An error is only returned if the target is invalid or ctx is done
+func DetectUpgrade(ctx context.Context, target string, variants []UpgradeVariant, opts ...ConnectionOption) ([]UpgradeVariantResult, error) {
+	if variants == nil {
+		variants = DefaultUpgradeVariants
+	}
+
+	ret := make([]UpgradeVariantResult, 0, len(variants))
+	for _, v := range variants {
+		r, err := detectVariant(ctx, target, v, opts...)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, r)
+		if ctx.Err() != nil {
+			return ret, ctx.Err()
+		}
+	}
+	return ret, nil
+}
+
+// detectVariant will upgrade a new connection to target with the variant
+func detectVariant(ctx context.Context, target string, v UpgradeVariant, opts ...ConnectionOption) (r UpgradeVariantResult, err error) {
+	r.Variant = v
+	c, err := NewConn(target, opts...)
+	if err != nil {
+		return r, err
+	}
+	defer c.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return r, err
+	}
+
+	res, err := c.DoUpgradeContext(ctx, req, v.Options...)
+	r.Result = c.UpgradeResult()
+	r.Upgraded = r.Result != nil && r.Result.Upgraded
+	if err != nil {
+		var uscErr http2.UnexpectedStatusCodeError
+		if errors.As(err, &uscErr) {
+			r.StatusCode = uscErr.Code
+		}
+		r.Err = err
+		log.WithField("target", target).WithField("variant", v.Name).WithError(err).Tracef("variant failed")
+		return r, nil
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	r.Stream1 = true
+	r.StatusCode = res.StatusCode
+	return r, nil
+}
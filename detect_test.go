@@ -0,0 +1,59 @@
+package h2csmuggler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDetectUpgrade(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	defer s.Close()
+
+	results, err := DetectUpgrade(context.Background(), s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(DefaultUpgradeVariants) {
+		t.Fatalf("got %d results, want %d", len(results), len(DefaultUpgradeVariants))
+	}
+
+	// the h2c handler requires the Upgrade token and HTTP2-Settings to be nominated by Connection
+	want := map[string]bool{
+		"standard":                true,
+		"connection-upgrade-only": false,
+		"no-http2-settings":       false,
+		"no-connection":           false,
+		"uppercase-token":         true,
+		"lowercase-connection":    true,
+		"h2c-14":                  false,
+	}
+	for _, r := range results {
+		if r.Upgraded != want[r.Variant.Name] || r.Stream1 != want[r.Variant.Name] {
+			t.Errorf("%s: got upgraded %v stream1 %v, want %v", r.Variant.Name, r.Upgraded, r.Stream1, want[r.Variant.Name])
+		}
+		if r.Stream1 && r.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200", r.Variant.Name, r.StatusCode)
+		}
+		if !r.Upgraded && r.StatusCode != http.StatusOK {
+			t.Errorf("%s: got upgrade status %d, want the http/1.1 200", r.Variant.Name, r.StatusCode)
+		}
+	}
+}
+
+func TestDetectUpgradeCancelled(t *testing.T) {
+	l := startSilentServer(t)
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := DetectUpgrade(ctx, "http://"+l.Addr().String(), nil)
+	if err != context.Canceled {
+		t.Fatalf("got err %v, want context canceled", err)
+	}
+	if len(results) != 1 || results[0].Upgraded {
+		t.Errorf("got results %+v, want a single failed variant", results)
+	}
+}
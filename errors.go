@@ -0,0 +1,108 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+)
+
+// UpgradeErrorKind classifies why a connection could not be upgraded
+type UpgradeErrorKind string
+
+const (
+	KindDNS       UpgradeErrorKind = "dns"        // the target host could not be resolved
+	KindRefused   UpgradeErrorKind = "refused"    // the tcp connection was refused
+	KindConnect   UpgradeErrorKind = "connect"    // the tcp connection failed for another reason e.g. a timeout
+	KindTLS       UpgradeErrorKind = "tls"        // the tls handshake failed
+	KindStatus    UpgradeErrorKind = "status"     // the upgrade response was not a 101. See http2.UnexpectedStatusCodeError
+	KindNoPreface UpgradeErrorKind = "no-preface" // the server did not send its SETTINGS after the 101, or with prior knowledge
+	KindGoAway    UpgradeErrorKind = "goaway"     // the server sent a GOAWAY before responding on stream 1. See http2.GoAwayError
+	KindTimeout   UpgradeErrorKind = "timeout"    // timed out waiting for the upgrade response or the response on stream 1
+	KindClosed    UpgradeErrorKind = "closed"     // the connection was closed before the response was received
+	KindKeepAlive UpgradeErrorKind = "keep-alive" // the websocket upgrade was refused, and the proxy kept parsing the connection as HTTP/1.1
+	KindOther     UpgradeErrorKind = "other"      // any other failure e.g. a malformed upgrade response
+)
+
+// UpgradeError is returned by DoUpgrade and Do when the connection could not be upgraded.
+// The underlying error, such as a *net.DNSError or http2.UnexpectedStatusCodeError, is
+// available with errors.As. Errors caused by the context being cancelled or expiring are not
+// classified
+type UpgradeError struct {
+	Kind UpgradeErrorKind
+	Err  error
+}
+
+func (e *UpgradeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpgradeError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKind will return the kind of the UpgradeError in err's chain, or "" if there is none
+func ErrorKind(err error) UpgradeErrorKind {
+	var uerr *UpgradeError
+	if errors.As(err, &uerr) {
+		return uerr.Kind
+	}
+	return ""
+}
+
+// upgradeError will classify err as kind, unless ctx is done
+func upgradeError(ctx context.Context, kind UpgradeErrorKind, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return &UpgradeError{Kind: kind, Err: err}
+}
+
+// dialErrorKind will classify an error establishing the tcp connection
+func dialErrorKind(err error) UpgradeErrorKind {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return KindDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return KindRefused
+	}
+	return KindConnect
+}
+
+// responseErrorKind will classify an error upgrading the connection and reading the response
+// on stream 1. info is what was recorded of the upgrade, and upgraded is whether the server
+// should have sent its SETTINGS
+func responseErrorKind(err error, info *http2.UpgradeInfo, upgraded bool) UpgradeErrorKind {
+	var (
+		uscErr  http2.UnexpectedStatusCodeError
+		goAway  http2.GoAwayError
+		upgrade = upgraded || (info.Response != nil && info.Response.StatusCode == 101)
+	)
+	switch {
+	case errors.As(err, &uscErr):
+		return KindStatus
+	case errors.As(err, &goAway):
+		return KindGoAway
+	case upgrade && info.ServerSettings == nil:
+		return KindNoPreface
+	}
+	return tunnelErrorKind(err)
+}
+
+// tunnelErrorKind will classify an error sending a request over a tunnel, or reading its
+// response
+func tunnelErrorKind(err error) UpgradeErrorKind {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrResponseTimeout),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return KindClosed
+	}
+	return KindOther
+}
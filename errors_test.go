@@ -0,0 +1,145 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+)
+
+// startUpgradeServer will start a server which responds to the upgrade request with a 101,
+// then calls fn with a framer for the connection
+func startUpgradeServer(t *testing.T, fn func(fr *http2.Framer)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+				fn(http2.NewFramer(c, br))
+				ioutil.ReadAll(br)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestUpgradeErrorKind(t *testing.T) {
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.Close()
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	silent := startSilentServer(t)
+	defer silent.Close()
+
+	noPreface := startUpgradeServer(t, func(fr *http2.Framer) {})
+	defer noPreface.Close()
+
+	goAway := startUpgradeServer(t, func(fr *http2.Framer) {
+		fr.WriteSettings()
+		fr.WriteGoAway(0, http2.ErrCodeRefusedStream, []byte("go away"))
+	})
+	defer goAway.Close()
+
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closing.Close()
+	go func() {
+		for {
+			c, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(c))
+			c.Close()
+		}
+	}()
+
+	timeouts := ConnectionTimeouts(Timeouts{Upgrade: 200 * time.Millisecond, Response: 200 * time.Millisecond})
+	tests := []struct {
+		name   string
+		target string
+		opts   []ConnectionOption
+		want   UpgradeErrorKind
+	}{
+		{"dns", "http://smuggler.invalid", []ConnectionOption{ConnectionResolver(&countingResolver{})}, KindDNS},
+		{"refused", "http://" + refused.Addr().String(), nil, KindRefused},
+		{"tls", "https://" + plain.Listener.Addr().String(), nil, KindTLS},
+		{"status", plain.URL, nil, KindStatus},
+		{"no-preface", "http://" + noPreface.Addr().String(), []ConnectionOption{timeouts}, KindNoPreface},
+		{"goaway", "http://" + goAway.Addr().String(), []ConnectionOption{timeouts}, KindGoAway},
+		{"timeout", "http://" + silent.Addr().String(), []ConnectionOption{timeouts}, KindTimeout},
+		{"closed", "http://" + closing.Addr().String(), nil, KindClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConn(tt.target, append([]ConnectionOption{ConnectionMaxRetries(0)}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req, err := http.NewRequest("GET", tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.Do(req)
+			var uerr *UpgradeError
+			if !errors.As(err, &uerr) {
+				t.Fatalf("got err %v, want an UpgradeError", err)
+			}
+			if uerr.Kind != tt.want || ErrorKind(err) != tt.want {
+				t.Errorf("got kind %q (%v), want %q", uerr.Kind, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeErrorStatus(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("denied"))
+	}))
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Do(req)
+	var uscErr http2.UnexpectedStatusCodeError
+	if ErrorKind(err) != KindStatus || !errors.As(err, &uscErr) {
+		t.Fatalf("got err %v, want an unexpected status", err)
+	}
+	if uscErr.Code != http.StatusForbidden || string(uscErr.Response.Body) != "denied" {
+		t.Errorf("got status %d body %q, want the 403", uscErr.Code, uscErr.Response.Body)
+	}
+}
@@ -0,0 +1,71 @@
+package h2csmuggler
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+)
+
+// HeaderFields will return the http2 header fields for req without any validation. These are
+// the :authority, :method, :path and :scheme pseudo-headers with any overrides from
+// WithPseudoHeaders applied, followed by each header with its name lowercased, sorted by name.
+// Unlike the transport, connection-specific headers are kept and no defaults such as
+// user-agent are added
+func HeaderFields(req *http.Request) []hpack.HeaderField {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	overrides := http2.ContextPseudoHeaders(req.Context())
+	fields := http2.OverridePseudoHeaders([]hpack.HeaderField{
+		{Name: ":authority", Value: host},
+		{Name: ":method", Value: method},
+		{Name: ":path", Value: req.URL.RequestURI()},
+		{Name: ":scheme", Value: req.URL.Scheme},
+	}, overrides)
+	for _, hf := range overrides {
+		if hf.Name == ":authority" {
+			fields = append(fields, hpack.HeaderField{Name: "host", Value: host})
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	if req.ContentLength > 0 && req.Header.Get("Content-Length") == "" {
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.FormatInt(req.ContentLength, 10)})
+	}
+	return fields
+}
+
+// WithRawHeaders will return a shallow copy of req, which is sent over an upgraded connection
+// with exactly fields as its header block. Nothing is added, normalized or validated, which
+// allows malformed header blocks to be sent to the backend. Use HeaderFields to start from the
+// fields of the request. See http2.WithRawHeaders
+func WithRawHeaders(req *http.Request, fields ...hpack.HeaderField) *http.Request {
+	return req.WithContext(http2.WithRawHeaders(req.Context(), fields))
+}
+
+// WithPseudoHeaders will return a shallow copy of req, which is sent over an upgraded
+// connection with fields overriding its pseudo-headers. Fields replace the :authority,
+// :method, :path or :scheme of the same name, and any other fields are sent after them. The
+// override values are not validated. See http2.WithPseudoHeaders
+func WithPseudoHeaders(req *http.Request, fields ...hpack.HeaderField) *http.Request {
+	return req.WithContext(http2.WithPseudoHeaders(req.Context(), fields))
+}
@@ -0,0 +1,200 @@
+package h2csmuggler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+)
+
+func TestHeaderFields(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/a?b=c", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "internal"
+	req.Header.Set("Transfer-Encoding", "chunked")
+	req.Header["X-Dup"] = []string{"1", "2"}
+
+	want := []hpack.HeaderField{
+		{Name: ":authority", Value: "internal"},
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: "/a?b=c"},
+		{Name: ":scheme", Value: "http"},
+		{Name: "transfer-encoding", Value: "chunked"},
+		{Name: "x-dup", Value: "1"},
+		{Name: "x-dup", Value: "2"},
+		{Name: "content-length", Value: "4"},
+	}
+	if got := HeaderFields(req); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestConnRawHeaders(t *testing.T) {
+	var got http.Header
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	})
+	defer s.Close()
+
+	var (
+		mu   sync.Mutex
+		sent [][]hpack.HeaderField
+	)
+	observer := func(*url.URL) http2.FrameObserver {
+		return http2.FrameObserverFunc(func(e http2.FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if e.Direction == http2.FrameSent && e.Headers != nil {
+				sent = append(sent, e.Headers)
+			}
+		})
+	}
+	c, err := NewConn(s.URL, ConnectionFrameObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// a valid block is accepted by the server as is
+	req, err = http.NewRequest("GET", s.URL+"/valid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Do(WithRawHeaders(req, append(HeaderFields(req), hpack.HeaderField{Name: "x-raw", Value: "1"})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got.Get("X-Raw") != "1" || got.Get("User-Agent") != "" {
+		t.Errorf("got headers %v, want only x-raw", got)
+	}
+
+	// a malformed block is sent byte for byte, even though the server rejects it
+	malformed := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/a"},
+		{Name: ":path", Value: "/b"},
+		{Name: ":scheme", Value: "http"},
+		{Name: "Transfer-Encoding", Value: "chunked"},
+		{Name: "x-crlf", Value: "a\r\nb\x00"},
+	}
+	req, err = http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Do(WithRawHeaders(req, malformed...))
+	if err == nil {
+		res.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 {
+		t.Fatalf("got %d header blocks sent, want 2", len(sent))
+	}
+	if !reflect.DeepEqual(sent[1], malformed) {
+		t.Errorf("got header block %v, want %v", sent[1], malformed)
+	}
+}
+
+func TestConnPseudoHeaders(t *testing.T) {
+	var path string
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	})
+	defer s.Close()
+
+	var (
+		mu   sync.Mutex
+		sent [][]hpack.HeaderField
+	)
+	observer := func(*url.URL) http2.FrameObserver {
+		return http2.FrameObserverFunc(func(e http2.FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if e.Direction == http2.FrameSent && e.Headers != nil {
+				sent = append(sent, e.Headers)
+			}
+		})
+	}
+	c, err := NewConn(s.URL, ConnectionFrameObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req, err = http.NewRequest("GET", s.URL+"/original", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "front"
+	req = WithPseudoHeaders(req,
+		hpack.HeaderField{Name: ":path", Value: "/override"},
+		hpack.HeaderField{Name: ":authority", Value: "backend"},
+		hpack.HeaderField{Name: ":x-unknown", Value: "1"},
+	)
+	want := []hpack.HeaderField{
+		{Name: ":authority", Value: "backend"},
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/override"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":x-unknown", Value: "1"},
+		{Name: "host", Value: "front"},
+	}
+	if got := HeaderFields(req); !reflect.DeepEqual(got, want) {
+		t.Errorf("got fields %v, want %v", got, want)
+	}
+	// the server rejects the unknown pseudo-header
+	if res, err := c.Do(req); err == nil {
+		res.Body.Close()
+	}
+
+	req, err = http.NewRequest("GET", s.URL+"/original", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Do(WithPseudoHeaders(req, hpack.HeaderField{Name: ":path", Value: "/override"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if path != "/override" {
+		t.Errorf("got path %q, want /override", path)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 {
+		t.Fatalf("got %d header blocks sent, want 2", len(sent))
+	}
+	if got := sent[0][:len(want)]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got header block %v, want prefix %v", sent[0], want)
+	}
+}
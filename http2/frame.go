@@ -324,6 +324,14 @@ type Framer struct {
 	debugReadLoggerf  func(string, ...interface{})
 	debugWriteLoggerf func(string, ...interface{})
 
+	// writeHook, if non-nil, is called with each frame as it is written
+	writeHook func(frame []byte)
+
+	// readMetaPushPromises causes ReadFrame to return a
+	// MetaPushPromiseFrame for PUSH_PROMISE frames, when
+	// ReadMetaHeaders is set.
+	readMetaPushPromises bool
+
 	frameCache *frameCache // nil if frames aren't reused (default)
 }
 
@@ -362,6 +370,9 @@ func (f *Framer) endWrite() error {
 	if f.logWrites {
 		f.logWrite()
 	}
+	if f.writeHook != nil {
+		f.writeHook(f.wbuf)
+	}
 
 	n, err := f.w.Write(f.wbuf)
 	if err == nil && n != len(f.wbuf) {
@@ -516,6 +527,9 @@ func (fr *Framer) ReadFrame() (Frame, error) {
 	if fh.Type == FrameHeaders && fr.ReadMetaHeaders != nil {
 		return fr.readMetaFrame(f.(*HeadersFrame))
 	}
+	if fh.Type == FramePushPromise && fr.ReadMetaHeaders != nil && fr.readMetaPushPromises {
+		return fr.readMetaPushPromise(f.(*PushPromiseFrame))
+	}
 	return f, nil
 }
 
@@ -556,7 +570,8 @@ func (fr *Framer) checkFrameOrder(f Frame) error {
 	}
 
 	switch fh.Type {
-	case FrameHeaders, FrameContinuation:
+	case FrameHeaders, FrameContinuation, FramePushPromise:
+		// END_HEADERS is the same flag for all three
 		if fh.Flags.Has(FlagHeadersEndHeaders) {
 			fr.lastHeaderStream = 0
 		} else {
@@ -1530,29 +1545,13 @@ func (fr *Framer) readMetaFrame(hf *HeadersFrame) (*MetaHeadersFrame, error) {
 	// Lose reference to MetaHeadersFrame:
 	defer hdec.SetEmitFunc(func(hf hpack.HeaderField) {})
 
-	var hc headersOrContinuation = hf
-	for {
-		frag := hc.HeaderBlockFragment()
-		if _, err := hdec.Write(frag); err != nil {
-			return nil, ConnectionError(ErrCodeCompression)
-		}
-
-		if hc.HeadersEnded() {
-			break
-		}
-		if f, err := fr.ReadFrame(); err != nil {
-			return nil, err
-		} else {
-			hc = f.(*ContinuationFrame) // guaranteed by checkFrameOrder
-		}
+	if err := fr.readHeaderBlock(hdec, hf); err != nil {
+		return nil, err
 	}
 
 	mh.HeadersFrame.headerFragBuf = nil
 	mh.HeadersFrame.invalidate()
 
-	if err := hdec.Close(); err != nil {
-		return nil, ConnectionError(ErrCodeCompression)
-	}
 	if invalid != nil {
 		fr.errDetail = invalid
 		if VerboseLogs {
@@ -1570,6 +1569,86 @@ func (fr *Framer) readMetaFrame(hf *HeadersFrame) (*MetaHeadersFrame, error) {
 	return mh, nil
 }
 
+// readHeaderBlock writes the header block fragment of hc, and of the
+// CONTINUATION frames which follow it, to hdec.
+func (fr *Framer) readHeaderBlock(hdec *hpack.Decoder, hc headersOrContinuation) error {
+	for {
+		frag := hc.HeaderBlockFragment()
+		if _, err := hdec.Write(frag); err != nil {
+			return ConnectionError(ErrCodeCompression)
+		}
+
+		if hc.HeadersEnded() {
+			break
+		}
+		if f, err := fr.ReadFrame(); err != nil {
+			return err
+		} else {
+			hc = f.(*ContinuationFrame) // guaranteed by checkFrameOrder
+		}
+	}
+
+	if err := hdec.Close(); err != nil {
+		return ConnectionError(ErrCodeCompression)
+	}
+	return nil
+}
+
+// A MetaPushPromiseFrame is the representation of one PUSH_PROMISE
+// frame and zero or more contiguous CONTINUATION frames and the
+// decoding of their HPACK-encoded contents.
+//
+// This type of frame does not appear on the wire and is only returned
+// by the Framer of a ClientConn.
+type MetaPushPromiseFrame struct {
+	*PushPromiseFrame
+
+	// Fields are the fields of the promised request, as sent. Unlike
+	// MetaHeadersFrame, they are not validated. The underlying slice
+	// is owned by the Framer and must not be retained after the next
+	// call to ReadFrame.
+	Fields []hpack.HeaderField
+
+	// Truncated is whether the max header list size limit was hit
+	// and Fields is incomplete.
+	Truncated bool
+}
+
+// readMetaPushPromise returns 0 or more CONTINUATION frames from fr and
+// merges them into the provided pp.
+func (fr *Framer) readMetaPushPromise(pp *PushPromiseFrame) (*MetaPushPromiseFrame, error) {
+	if fr.AllowIllegalReads {
+		return nil, errors.New("illegal use of AllowIllegalReads with ReadMetaHeaders")
+	}
+	mp := &MetaPushPromiseFrame{
+		PushPromiseFrame: pp,
+	}
+	var remainSize = fr.maxHeaderListSize()
+
+	hdec := fr.ReadMetaHeaders
+	hdec.SetEmitEnabled(true)
+	hdec.SetMaxStringLength(fr.maxHeaderStringLen())
+	hdec.SetEmitFunc(func(hf hpack.HeaderField) {
+		size := hf.Size()
+		if size > remainSize {
+			hdec.SetEmitEnabled(false)
+			mp.Truncated = true
+			return
+		}
+		remainSize -= size
+		mp.Fields = append(mp.Fields, hf)
+	})
+	defer hdec.SetEmitFunc(func(hf hpack.HeaderField) {})
+
+	if err := fr.readHeaderBlock(hdec, pp); err != nil {
+		return nil, err
+	}
+
+	mp.PushPromiseFrame.headerFragBuf = nil
+	mp.PushPromiseFrame.invalidate()
+	return mp, nil
+}
+
 func summarizeFrame(f Frame) string {
 	var buf bytes.Buffer
 	f.Header().writeDebug(&buf)
@@ -19,6 +19,9 @@ package http2 // import "github.com/assetnote/h2csmuggler/http2"
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -172,6 +175,77 @@ func (s SettingID) String() string {
 	return fmt.Sprintf("UNKNOWN_SETTING_%d", uint16(s))
 }
 
+// ParseSettingID parses a setting name, such as INITIAL_WINDOW_SIZE, or
+// its numeric identifier in decimal or hex, such as 4 or 0x4. The
+// SETTINGS_ prefix is optional and names are case insensitive.
+func ParseSettingID(s string) (SettingID, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SETTINGS_")
+	for id, v := range settingName {
+		if v == name {
+			return id, nil
+		}
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(name, "UNKNOWN_SETTING_"), 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("http2: unknown setting %q", s)
+	}
+	return SettingID(id), nil
+}
+
+// ParseSetting parses a setting of the form ID=VALUE, where ID is as
+// accepted by ParseSettingID. The value is not validated.
+func ParseSetting(s string) (Setting, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return Setting{}, fmt.Errorf("http2: setting %q is not of the form ID=VALUE", s)
+	}
+	id, err := ParseSettingID(strings.TrimSpace(s[:i]))
+	if err != nil {
+		return Setting{}, err
+	}
+	val, err := strconv.ParseUint(strings.TrimSpace(s[i+1:]), 0, 32)
+	if err != nil {
+		return Setting{}, fmt.Errorf("http2: invalid value for setting %q", s)
+	}
+	return Setting{ID: id, Val: uint32(val)}, nil
+}
+
+// EncodeSettings encodes settings as the payload of a SETTINGS frame in
+// base64url without padding, as sent in the HTTP2-Settings header of an
+// h2c upgrade.
+func EncodeSettings(settings []Setting) string {
+	b := make([]byte, 6*len(settings))
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(b[i*6:], uint16(s.ID))
+		binary.BigEndian.PutUint32(b[i*6+2:], s.Val)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errSettingsLength = errors.New("http2: settings payload is not a multiple of 6 bytes")
+
+// DecodeSettings decodes the value of an HTTP2-Settings header. Padding
+// and the standard base64 alphabet are tolerated.
+func DecodeSettings(v string) ([]Setting, error) {
+	v = strings.TrimRight(strings.TrimSpace(v), "=")
+	v = strings.NewReplacer("+", "-", "/", "_").Replace(v)
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("http2: invalid settings encoding: %v", err)
+	}
+	if len(b)%6 != 0 {
+		return nil, errSettingsLength
+	}
+	settings := make([]Setting, 0, len(b)/6)
+	for i := 0; i < len(b); i += 6 {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(b[i:])),
+			Val: binary.BigEndian.Uint32(b[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
 // validWireHeaderFieldName reports whether v is a valid header field
 // name (key). See httpguts.ValidHeaderName for the base rules.
 //
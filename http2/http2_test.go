@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"net/http"
 	"os/exec"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -49,6 +50,56 @@ func TestSettingString(t *testing.T) {
 	}
 }
 
+func TestParseSetting(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Setting
+		err  bool
+	}{
+		{in: "ENABLE_PUSH=1", want: Setting{SettingEnablePush, 1}},
+		{in: "settings_initial_window_size = 65535", want: Setting{SettingInitialWindowSize, 65535}},
+		{in: "0x8=1", want: Setting{8, 1}},
+		{in: "UNKNOWN_SETTING_9=0x10", want: Setting{9, 16}},
+		{in: "ENABLE_PUSH", err: true},
+		{in: "NOPE=1", err: true},
+		{in: "3=4294967296", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSetting(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseSetting(%q) error = %v; want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSetting(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeDecodeSettings(t *testing.T) {
+	settings := []Setting{
+		{SettingMaxConcurrentStreams, 100},
+		{SettingInitialWindowSize, 1 << 30},
+		{SettingEnablePush, 0},
+	}
+	const want = "AAMAAABkAARAAAAAAAIAAAAA"
+	if got := EncodeSettings(settings); got != want {
+		t.Fatalf("EncodeSettings = %q; want %q", got, want)
+	}
+	for _, v := range []string{want, want + "==", " " + want} {
+		got, err := DecodeSettings(v)
+		if err != nil {
+			t.Fatalf("DecodeSettings(%q): %v", v, err)
+		}
+		if !reflect.DeepEqual(got, settings) {
+			t.Errorf("DecodeSettings(%q) = %v; want %v", v, got, settings)
+		}
+	}
+	if _, err := DecodeSettings("AAMAAABkAA"); err == nil {
+		t.Errorf("expected an error for a truncated setting")
+	}
+}
+
 type twriter struct {
 	t  testing.TB
 	st *serverTester // optional
@@ -0,0 +1,129 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+)
+
+// FrameDirection is whether a frame was sent or received by the client
+type FrameDirection uint8
+
+const (
+	FrameReceived FrameDirection = iota
+	FrameSent
+)
+
+func (d FrameDirection) String() string {
+	if d == FrameSent {
+		return "sent"
+	}
+	return "recv"
+}
+
+// FrameEvent is a single frame read or written by a ClientConn.
+type FrameEvent struct {
+	Direction FrameDirection
+	Time      time.Time
+
+	// Frame is only valid until ObserveFrame returns. Frames which
+	// are sent are decoded from the bytes written to the connection.
+	Frame Frame
+
+	// Headers is the decoded header block, set on the HEADERS,
+	// PUSH_PROMISE or CONTINUATION frame which ends the block.
+	Headers []hpack.HeaderField
+}
+
+// String summarises the frame and its headers on a single line.
+func (e FrameEvent) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v %s", e.Direction, summarizeFrame(e.Frame))
+	for _, hf := range e.Headers {
+		fmt.Fprintf(&buf, " %s=%q", hf.Name, hf.Value)
+	}
+	return buf.String()
+}
+
+// FrameObserver receives every frame read or written by a ClientConn,
+// in order. ObserveFrame is called synchronously from the read loop or
+// while writing, so it must not block or use the ClientConn.
+type FrameObserver interface {
+	ObserveFrame(FrameEvent)
+}
+
+// FrameObserverFunc is an adapter to allow a function to be used as a
+// FrameObserver.
+type FrameObserverFunc func(FrameEvent)
+
+func (f FrameObserverFunc) ObserveFrame(e FrameEvent) { f(e) }
+
+// frameWriteObserver decodes the frames written by a Framer for a
+// FrameObserver. Writes are serialised by the Framer, so no locking is
+// needed.
+type frameWriteObserver struct {
+	o   FrameObserver
+	buf bytes.Buffer
+	fr  *Framer
+
+	// the header block being written, decoded with the same dynamic
+	// table as the client's encoder
+	dec    *hpack.Decoder
+	fields []hpack.HeaderField
+}
+
+func newFrameWriteObserver(o FrameObserver) *frameWriteObserver {
+	w := &frameWriteObserver{o: o}
+	w.fr = NewFramer(nil, &w.buf)
+	w.fr.AllowIllegalReads = true
+	w.dec = hpack.NewDecoder(initialHeaderTableSize, func(hf hpack.HeaderField) {
+		w.fields = append(w.fields, hf)
+	})
+	return w
+}
+
+func (w *frameWriteObserver) wrote(frame []byte) {
+	w.buf.Reset()
+	w.buf.Write(frame)
+	f, err := w.fr.ReadFrame()
+	if err != nil {
+		return
+	}
+
+	e := FrameEvent{Direction: FrameSent, Time: time.Now(), Frame: f}
+	var frag []byte
+	var end bool
+	switch f := f.(type) {
+	case *HeadersFrame:
+		w.fields = nil
+		frag, end = f.HeaderBlockFragment(), f.HeadersEnded()
+	case *PushPromiseFrame:
+		w.fields = nil
+		frag, end = f.HeaderBlockFragment(), f.HeadersEnded()
+	case *ContinuationFrame:
+		frag, end = f.HeaderBlockFragment(), f.HeadersEnded()
+	}
+	if frag != nil {
+		w.dec.Write(frag)
+		if end {
+			w.dec.Close()
+			e.Headers = w.fields
+			w.fields = nil
+		}
+	}
+	w.o.ObserveFrame(e)
+}
+
+// observeRead passes a frame read by the read loop to the observer.
+func (cc *ClientConn) observeRead(f Frame) {
+	e := FrameEvent{Direction: FrameReceived, Time: time.Now(), Frame: f}
+	switch f := f.(type) {
+	case *MetaHeadersFrame:
+		e.Headers = f.Fields
+	case *MetaPushPromiseFrame:
+		e.Headers = f.Fields
+	}
+	cc.t.FrameObserver.ObserveFrame(e)
+}
@@ -25,6 +25,7 @@ import (
 	"net/http/httptrace"
 	"net/http/httputil"
 	"net/textproto"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -59,6 +60,15 @@ const (
 
 const DefaultH2CTimeout = 5 * time.Second
 
+// DefaultExpectContinueTimeout is how long the body of an upgrade request with
+// Expect: 100-continue is held back waiting for the 100 Continue, when the Transport
+// has no ExpectContinueTimeout of its own
+const DefaultExpectContinueTimeout = 1 * time.Second
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of network operations.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // Transport is an HTTP/2 Transport.
 //
 // A Transport internally caches connections to servers. It is safe
@@ -129,6 +139,20 @@ type Transport struct {
 	// Defaults to 15s.
 	PingTimeout time.Duration
 
+	// Settings, if non-nil, are sent verbatim in the SETTINGS frame of the
+	// client preface instead of the defaults. They are not validated, so
+	// unknown, duplicate or out of range settings can be sent deliberately.
+	// See InitialSettings.
+	Settings []Setting
+
+	// FrameObserver, if non-nil, receives every frame read or written
+	// by each ClientConn.
+	FrameObserver FrameObserver
+
+	// PushHandler, if non-nil, enables server push. Each promised
+	// request is passed to the handler along with its response.
+	PushHandler PushHandler
+
 	// t1, if non-nil, is the standard library Transport using
 	// this transport. Its settings are used (but not its
 	// RoundTrip method, etc).
@@ -148,6 +172,46 @@ func (t *Transport) maxHeaderListSize() uint32 {
 	return t.MaxHeaderListSize
 }
 
+// InitialSettings returns the settings sent in the SETTINGS frame of the
+// client preface. These are Settings if set, otherwise the defaults.
+func (t *Transport) InitialSettings() []Setting {
+	if t.Settings != nil {
+		return append([]Setting(nil), t.Settings...)
+	}
+	var push uint32
+	if t.PushHandler != nil {
+		push = 1
+	}
+	settings := []Setting{
+		{ID: SettingEnablePush, Val: push},
+		{ID: SettingInitialWindowSize, Val: transportDefaultStreamFlow},
+	}
+	if max := t.maxHeaderListSize(); max != 0 {
+		settings = append(settings, Setting{ID: SettingMaxHeaderListSize, Val: max})
+	}
+	return settings
+}
+
+// Clone returns a copy of t's exported configuration, sharing its
+// ConnPool and underlying net/http Transport, if any.
+func (t *Transport) Clone() *Transport {
+	return &Transport{
+		DialTLS:                    t.DialTLS,
+		TLSClientConfig:            t.TLSClientConfig,
+		ConnPool:                   t.ConnPool,
+		DisableCompression:         t.DisableCompression,
+		AllowHTTP:                  t.AllowHTTP,
+		MaxHeaderListSize:          t.MaxHeaderListSize,
+		StrictMaxConcurrentStreams: t.StrictMaxConcurrentStreams,
+		ReadIdleTimeout:            t.ReadIdleTimeout,
+		PingTimeout:                t.PingTimeout,
+		Settings:                   append([]Setting(nil), t.Settings...),
+		FrameObserver:              t.FrameObserver,
+		PushHandler:                t.PushHandler,
+		t1:                         t.t1,
+	}
+}
+
 func (t *Transport) disableCompression() bool {
 	return t.DisableCompression || (t.t1 != nil && t.t1.DisableCompression)
 }
@@ -252,7 +316,8 @@ type ClientConn struct {
 	wantSettingsAck bool                     // we sent a SETTINGS frame and haven't heard back
 	goAway          *GoAwayFrame             // if non-nil, the GoAwayFrame we received
 	goAwayDebug     string                   // goAway frame's debug data, retained as a string
-	streams         map[uint32]*clientStream // client-initiated
+	streams         map[uint32]*clientStream // client-initiated and pushed
+	pushedStreams   int                      // number of streams in streams promised by the server
 	nextStreamID    uint32
 	// is only updated on reciept of new headers (indicating a new request)
 	pendingRequests int                       // requests blocked and waiting to be sent because len(streams) == maxConcurrentStreams
@@ -267,6 +332,9 @@ type ClientConn struct {
 	maxConcurrentStreams  uint32
 	peerMaxHeaderListSize uint64
 	initialWindowSize     uint32
+	streamFlow            int32     // our initial stream-level flow control window, as advertised
+	serverSettings        []Setting // the peer's initial SETTINGS, as sent
+	gotServerSettings     bool
 
 	hbuf    bytes.Buffer // HPACK encoder writes into this
 	henc    *hpack.Encoder
@@ -577,7 +645,7 @@ func (t *Transport) dialClientConn(addr string, singleUse bool) (*ClientConn, er
 	if err != nil {
 		return nil, err
 	}
-	return t.newClientConn(tconn, nil, singleUse)
+	return t.newClientConn(tconn, nil, nil, singleUse)
 }
 
 func (t *Transport) newTLSConfig(host string) *tls.Config {
@@ -638,11 +706,45 @@ func (t *Transport) expectContinueTimeout() time.Duration {
 }
 
 func (t *Transport) NewClientConn(c net.Conn) (*ClientConn, error) {
-	return t.newClientConn(c, nil, t.disableKeepAlives())
+	return t.newClientConn(c, nil, nil, t.disableKeepAlives())
 }
 
 type UnexpectedStatusCodeError struct {
-	Code int
+	Code     int
+	Response *UpgradeResponse // the response to the upgrade request
+}
+
+// UpgradeResponse is the HTTP/1.1 response to a h2c upgrade request, with its body read
+type UpgradeResponse struct {
+	StatusLine string      `json:"status_line"` // e.g. HTTP/1.1 101 Switching Protocols
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// UpgradeInfo is filled in as the h2c upgrade progresses, when attached to the request
+// context with WithUpgradeInfo. This is available whether or not the upgrade succeeds
+type UpgradeInfo struct {
+	Response       *UpgradeResponse // the final HTTP/1.1 response to the upgrade request
+	ServerSettings []Setting        // the server's initial SETTINGS, once upgraded
+
+	// EarlyData is the number of bytes the server sent after the 101 which were read along
+	// with it. Compliant servers wait for the client preface, so these are usually frames
+	// written immediately by the server. They are handed to the framer rather than dropped
+	EarlyData int
+}
+
+type upgradeInfoKey struct{}
+
+// WithUpgradeInfo returns a context which records the upgrade into info, when used as the
+// context of the request passed to H2CUpgradeRequestContext
+func WithUpgradeInfo(ctx context.Context, info *UpgradeInfo) context.Context {
+	return context.WithValue(ctx, upgradeInfoKey{}, info)
+}
+
+func contextUpgradeInfo(ctx context.Context) *UpgradeInfo {
+	info, _ := ctx.Value(upgradeInfoKey{}).(*UpgradeInfo)
+	return info
 }
 
 func (u UnexpectedStatusCodeError) Error() string {
@@ -652,61 +754,127 @@ func (u UnexpectedStatusCodeError) Error() string {
 // H2CUpgradeRequest will perform the http2 upgrade on the connection and then retrieve the response
 // AllowHTTP must be enabled for this to work
 func (t *Transport) H2CUpgradeRequest(req *http.Request, c net.Conn) (*ClientConn, *http.Response, error) {
+	return t.H2CUpgradeRequestContext(context.Background(), req, c)
+}
+
+// H2CUpgradeRequestContext is like H2CUpgradeRequest, however ctx bounds sending the upgrade
+// request and reading the HTTP/1.1 response. If ctx has no deadline, DefaultH2CTimeout is used.
+// The request context is only used for the response on stream 1.
+func (t *Transport) H2CUpgradeRequestContext(ctx context.Context, req *http.Request, c net.Conn) (*ClientConn, *http.Response, error) {
 	if !t.AllowHTTP {
 		return nil, nil, errors.New("http2: allowhttp not enabled.")
 	}
 
-	raw, err := httputil.DumpRequestOut(req, true)
+	// DumpRequestOut performs a fake round trip, so detach the request's trace hooks from it
+	dumpReq := req.WithContext(context.Background())
+	raw, err := httputil.DumpRequestOut(dumpReq, true)
 	if err != nil {
 		return nil, nil, xerrors.Wrap(err, "failed to dump http body")
 	}
+	// the dump replaces the body with an unread copy
+	req.Body = dumpReq.Body
+	return t.h2cUpgrade(ctx, raw, req, c)
+}
 
-	_, err = c.Write(raw)
-	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to send initial request")
+// H2CUpgradeRawRequestContext is like H2CUpgradeRequestContext, however raw is written to the
+// connection verbatim as the upgrade request. This allows for requests which cannot be
+// represented by a http.Request, such as duplicate or folded headers. req is not written, and
+// only describes the request on stream 1 that the response is read for
+func (t *Transport) H2CUpgradeRawRequestContext(ctx context.Context, raw []byte, req *http.Request, c net.Conn) (*ClientConn, *http.Response, error) {
+	if !t.AllowHTTP {
+		return nil, nil, errors.New("http2: allowhttp not enabled.")
 	}
+	return t.h2cUpgrade(ctx, raw, req, c)
+}
 
-	// ensure that our read will terminate and not hang forever
-	c.SetReadDeadline(time.Now().Add(DefaultH2CTimeout))
-	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
-	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to parse response")
+// h2cUpgrade will write the raw upgrade request, and read the response to req on stream 1
+func (t *Transport) h2cUpgrade(ctx context.Context, raw []byte, req *http.Request, c net.Conn) (*ClientConn, *http.Response, error) {
+	// ensure that our write and read will terminate and not hang forever
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultH2CTimeout)
+	}
+	c.SetDeadline(deadline)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock any pending io on the conn
+			c.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	resp, body, early, err := t.readUpgradeResponse(raw, c)
+	close(stop)
+	var ne net.Error
+	if _, hasDeadline := ctx.Deadline(); hasDeadline && errors.As(err, &ne) && ne.Timeout() {
+		// the conn deadline can fire just before the context's own timer. Report it
+		// the same way as the context expiring
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
 	}
-	defer resp.Body.Close()
-
-	// disarm our read deadline for the initial response before we hand it over
-	c.SetReadDeadline(time.Time{})
-
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to read body")
+		return nil, nil, err
 	}
 
+	// disarm our deadline for the initial response before we hand it over
+	c.SetDeadline(time.Time{})
+
 	logrus.WithFields(logrus.Fields{
 		"status":  resp.StatusCode,
 		"body":    string(body),
 		"headers": resp.Header,
 	}).Tracef("upgrade request complete")
 
+	upgradeRes := &UpgradeResponse{
+		StatusLine: resp.Proto + " " + resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}
+	info := contextUpgradeInfo(req.Context())
+	if info != nil {
+		info.Response = upgradeRes
+	}
+
 	if resp.StatusCode != 101 {
 		logrus.Tracef("unexpected status code: %v", resp.StatusCode)
-		return nil, nil, UnexpectedStatusCodeError{Code: resp.StatusCode}
+		return nil, nil, UnexpectedStatusCodeError{Code: resp.StatusCode, Response: upgradeRes}
+	}
+	if len(early) > 0 {
+		logrus.WithField("bytes", len(early)).Debugf("server sent http2 data with the upgrade response")
+		if info != nil {
+			info.EarlyData = len(early)
+		}
 	}
+	// the upgrade request doubles as the request on stream 1, which is now written
+	traceWroteRequest(httptrace.ContextClientTrace(req.Context()), nil)
 
-	cc, err := t.newClientConn(c, req, t.disableKeepAlives())
+	cc, err := t.newClientConn(c, req, early, t.disableKeepAlives())
 	if err != nil {
 		return nil, nil, xerrors.Wrap(err, "Client conn failed")
 	}
 
 	// Clean up the body as per our contract
-	_, err = io.Copy(ioutil.Discard, req.Body)
-	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Body copy failed")
+	if req.Body != nil {
+		_, err = io.Copy(ioutil.Discard, req.Body)
+		if err != nil {
+			return nil, nil, xerrors.Wrap(err, "Body copy failed")
+		}
+		req.Body.Close()
 	}
-	req.Body.Close()
 
 	res, err := cc.readFirstResponse(req)
+	if info != nil {
+		info.ServerSettings, _ = cc.ServerSettings()
+	}
 	if err != nil {
+		// report a GOAWAY which refused stream 1 with the server's error code
+		if goAway, ok := cc.GoAway(); ok {
+			err = goAway
+		}
 		cc.Close()
 		return nil, nil, xerrors.Wrap(err, "read first response failed")
 	}
@@ -716,7 +884,95 @@ func (t *Transport) H2CUpgradeRequest(req *http.Request, c net.Conn) (*ClientCon
 	return cc, res, err
 }
 
-func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, singleUse bool) (*ClientConn, error) {
+// readUpgradeResponse writes the raw upgrade request to c and reads the HTTP/1.1 response
+// and its body. If the request has Expect: 100-continue, the body is only written once the
+// server responds with 100 Continue, or after the expect continue timeout. Any other
+// interim responses before the 101 are skipped. Any bytes read past the end of the
+// response are returned as early
+func (t *Transport) readUpgradeResponse(raw []byte, c net.Conn) (resp *http.Response, body []byte, early []byte, err error) {
+	head, reqBody, expect := splitExpectContinue(raw)
+	_, err = c.Write(head)
+	if err != nil {
+		return nil, nil, nil, xerrors.Wrap(err, "Failed to send initial request")
+	}
+
+	// the body is sent at most once, either on the 100 Continue or the timeout. If a final
+	// response arrives first, the body is never sent
+	var (
+		once sync.Once
+		werr error
+	)
+	sendBody := func(send bool) error {
+		once.Do(func() {
+			if send {
+				_, werr = c.Write(reqBody)
+			}
+		})
+		return werr
+	}
+	if expect {
+		timeout := t.expectContinueTimeout()
+		if timeout == 0 {
+			timeout = DefaultExpectContinueTimeout
+		}
+		timer := time.AfterFunc(timeout, func() { sendBody(true) })
+		defer timer.Stop()
+	}
+
+	br := bufio.NewReader(c)
+	for {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return nil, nil, nil, xerrors.Wrap(err, "Failed to parse response")
+		}
+		if resp.StatusCode == http.StatusContinue && expect {
+			if err := sendBody(true); err != nil {
+				return nil, nil, nil, xerrors.Wrap(err, "Failed to send request body")
+			}
+			continue
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			logrus.WithField("status", resp.StatusCode).Tracef("skipping interim response")
+			continue
+		}
+		if expect {
+			sendBody(false)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, nil, xerrors.Wrap(err, "Failed to read body")
+		}
+		if n := br.Buffered(); n > 0 {
+			early, _ = br.Peek(n)
+		}
+		return resp, body, early, nil
+	}
+}
+
+// splitExpectContinue will split the raw request into the header and the body if the request
+// has the Expect: 100-continue header. Otherwise the whole request is returned as the head
+func splitExpectContinue(raw []byte) (head []byte, body []byte, expect bool) {
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		return raw, nil, false
+	}
+	head, body = raw[:i+4], raw[i+4:]
+	for _, line := range strings.Split(string(head), "\r\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "Expect") &&
+			strings.EqualFold(strings.TrimSpace(kv[1]), "100-continue") {
+			return head, body, true
+		}
+	}
+	return raw, nil, false
+}
+
+// newClientConn creates a ClientConn on c. early is any data which was already read from c,
+// and is read by the framer before c
+func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, early []byte, singleUse bool) (*ClientConn, error) {
+	initialSettings := t.InitialSettings()
 	cc := &ClientConn{
 		t:                     t,
 		tconn:                 c,
@@ -731,6 +987,7 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 		singleUse:             singleUse,
 		wantSettingsAck:       true,
 		pings:                 make(map[[8]byte]chan struct{}),
+		streamFlow:            initialStreamFlow(initialSettings),
 	}
 	if d := t.idleConnTimeout(); d != 0 {
 		cc.idleTimeout = d
@@ -746,10 +1003,18 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 	// TODO: adjust this writer size to account for frame size +
 	// MTU + crypto/tls record padding.
 	cc.bw = bufio.NewWriter(stickyErrWriter{c, &cc.werr})
-	cc.br = bufio.NewReader(c)
+	if len(early) > 0 {
+		cc.br = bufio.NewReader(io.MultiReader(bytes.NewReader(early), c))
+	} else {
+		cc.br = bufio.NewReader(c)
+	}
 	cc.fr = NewFramer(cc.bw, cc.br)
 	cc.fr.ReadMetaHeaders = hpack.NewDecoder(initialHeaderTableSize, nil)
+	cc.fr.readMetaPushPromises = true
 	cc.fr.MaxHeaderListSize = t.maxHeaderListSize()
+	if t.FrameObserver != nil {
+		cc.fr.writeHook = newFrameWriteObserver(t.FrameObserver).wrote
+	}
 
 	// TODO: SetMaxDynamicTableSize, SetMaxDynamicTableSizeLimit on
 	// henc in response to SETTINGS frames?
@@ -769,14 +1034,6 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 		cc.tlsState = &state
 	}
 
-	initialSettings := []Setting{
-		{ID: SettingEnablePush, Val: 0},
-		{ID: SettingInitialWindowSize, Val: transportDefaultStreamFlow},
-	}
-	if max := t.maxHeaderListSize(); max != 0 {
-		initialSettings = append(initialSettings, Setting{ID: SettingMaxHeaderListSize, Val: max})
-	}
-
 	cc.bw.Write(clientPreface)
 	cc.fr.WriteSettings(initialSettings...)
 	cc.fr.WriteWindowUpdate(0, transportDefaultConnFlow)
@@ -790,6 +1047,19 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 	return cc, nil
 }
 
+// initialStreamFlow returns the stream-level flow control window advertised
+// by settings. Invalid windows are ignored, as the server is expected to
+// reject them.
+func initialStreamFlow(settings []Setting) int32 {
+	flow := int32(initialWindowSize)
+	for _, s := range settings {
+		if s.ID == SettingInitialWindowSize && s.Valid() == nil {
+			flow = int32(s.Val)
+		}
+	}
+	return flow
+}
+
 func (cc *ClientConn) healthCheck() {
 	pingTimeout := cc.t.pingTimeout()
 	// We don't need to periodically ping in the health check, because the readLoop of ClientConn will
@@ -829,6 +1099,31 @@ func (cc *ClientConn) setGoAway(f *GoAwayFrame) {
 	}
 }
 
+// GoAway returns the GOAWAY frame received from the server, if any
+func (cc *ClientConn) GoAway() (GoAwayError, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.goAway == nil {
+		return GoAwayError{}, false
+	}
+	return GoAwayError{
+		LastStreamID: cc.goAway.LastStreamID,
+		ErrCode:      cc.goAway.ErrCode,
+		DebugData:    cc.goAwayDebug,
+	}, true
+}
+
+// ServerSettings returns the settings from the server's initial SETTINGS frame, in the order
+// they were sent. ok is false if the SETTINGS frame has not been received yet
+func (cc *ClientConn) ServerSettings() (settings []Setting, ok bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.gotServerSettings {
+		return nil, false
+	}
+	return append([]Setting{}, cc.serverSettings...), true
+}
+
 // CanTakeNewRequest reports whether the connection can take a new request,
 // meaning it has not been closed or received or sent a GOAWAY.
 func (cc *ClientConn) CanTakeNewRequest() bool {
@@ -862,7 +1157,7 @@ func (cc *ClientConn) idleStateLocked() (st clientConnIdleState) {
 		// writing it.
 		maxConcurrentOkay = true
 	} else {
-		maxConcurrentOkay = int64(len(cc.streams)+1) < int64(cc.maxConcurrentStreams)
+		maxConcurrentOkay = int64(cc.activeStreamsLocked()+1) < int64(cc.maxConcurrentStreams)
 	}
 
 	st.canTakeNewRequest = cc.goAway == nil && !cc.closed && !cc.closing && maxConcurrentOkay &&
@@ -989,6 +1284,7 @@ func (cc *ClientConn) closeForError(err error) error {
 		cs.bufPipe.CloseWithError(err)
 		delete(cc.streams, id)
 	}
+	cc.pushedStreams = 0
 	cc.closed = true
 	return cc.tconn.Close()
 }
@@ -1119,16 +1415,22 @@ func (cc *ClientConn) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAfterReqBodyWrite bool, err error) {
-	if err := checkConnHeaders(req); err != nil {
-		return nil, false, err
+	rawHeaders, isRaw := contextRawHeaders(req.Context())
+	if !isRaw {
+		if err := checkConnHeaders(req); err != nil {
+			return nil, false, err
+		}
 	}
 	if cc.idleTimer != nil {
 		cc.idleTimer.Stop()
 	}
 
-	trailers, err := commaSeparatedTrailers(req)
-	if err != nil {
-		return nil, false, err
+	var trailers string
+	if !isRaw {
+		trailers, err = commaSeparatedTrailers(req)
+		if err != nil {
+			return nil, false, err
+		}
 	}
 	hasTrailers := trailers != ""
 
@@ -1144,7 +1446,7 @@ func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAf
 
 	// TODO(bradfitz): this is a copy of the logic in net/http. Unify somewhere?
 	var requestedGzip bool
-	if !cc.t.disableCompression() &&
+	if !isRaw && !cc.t.disableCompression() &&
 		req.Header.Get("Accept-Encoding") == "" &&
 		req.Header.Get("Range") == "" &&
 		req.Method != "HEAD" {
@@ -1166,7 +1468,12 @@ func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAf
 	// we send: HEADERS{1}, CONTINUATION{0,} + DATA{0,} (DATA is
 	// sent by writeRequestBody below, along with any Trailers,
 	// again in form HEADERS{1}, CONTINUATION{0,})
-	hdrs, err := cc.encodeHeaders(req, requestedGzip, trailers, contentLen)
+	var hdrs []byte
+	if isRaw {
+		hdrs = cc.encodeRawHeaders(rawHeaders)
+	} else {
+		hdrs, err = cc.encodeHeaders(req, requestedGzip, trailers, contentLen)
+	}
 	if err != nil {
 		cc.mu.Unlock()
 		return nil, false, err
@@ -1327,14 +1634,29 @@ func (cc *ClientConn) readFirstResponse(req *http.Request) (*http.Response, erro
 			continue
 		}
 	}
-	res := <-cs.resc
+	var res resAndError
+	select {
+	case res = <-cs.resc:
+	case <-req.Context().Done():
+		cs.cancelStream()
+		return nil, req.Context().Err()
+	}
 	if res.res != nil {
 		res.res.Request = req
 	}
 	return res.res, res.err
 }
 
-// awaitOpenSlotForRequest waits until len(streams) < maxConcurrentStreams.
+// activeStreamsLocked returns the number of client-initiated streams.
+// Pushed streams don't count against the peer's SETTINGS_MAX_CONCURRENT_STREAMS,
+// which limits the streams the client may open.
+// Must hold cc.mu.
+func (cc *ClientConn) activeStreamsLocked() int {
+	return len(cc.streams) - cc.pushedStreams
+}
+
+// awaitOpenSlotForRequest waits until the client-initiated streams are below
+// maxConcurrentStreams.
 // Must hold cc.mu.
 func (cc *ClientConn) awaitOpenSlotForRequest(req *http.Request) error {
 	var waitingForConn chan struct{}
@@ -1348,7 +1670,7 @@ func (cc *ClientConn) awaitOpenSlotForRequest(req *http.Request) error {
 			return errClientConnUnusable
 		}
 		cc.lastIdle = time.Time{}
-		if int64(len(cc.streams))+1 <= int64(cc.maxConcurrentStreams) {
+		if int64(cc.activeStreamsLocked())+1 <= int64(cc.maxConcurrentStreams) {
 			if waitingForConn != nil {
 				close(waitingForConn)
 			}
@@ -1592,8 +1914,9 @@ func (cc *ClientConn) encodeHeaders(req *http.Request, addGzipHeader bool, trail
 		return nil, err
 	}
 
+	overrides := ContextPseudoHeaders(req.Context())
 	var path string
-	if req.Method != "CONNECT" {
+	if req.Method != "CONNECT" && !hasHeaderField(overrides, ":path") {
 		path = req.URL.RequestURI()
 		if !validPseudoPath(path) {
 			orig := path
@@ -1628,15 +1951,26 @@ func (cc *ClientConn) encodeHeaders(req *http.Request, addGzipHeader bool, trail
 		// target URI (the path-absolute production and optionally a '?' character
 		// followed by the query production (see Sections 3.3 and 3.4 of
 		// [RFC3986]).
-		f(":authority", host)
 		m := req.Method
 		if m == "" {
 			m = http.MethodGet
 		}
-		f(":method", m)
+		pseudo := []hpack.HeaderField{
+			{Name: ":authority", Value: host},
+			{Name: ":method", Value: m},
+		}
 		if req.Method != "CONNECT" {
-			f(":path", path)
-			f(":scheme", req.URL.Scheme)
+			pseudo = append(pseudo,
+				hpack.HeaderField{Name: ":path", Value: path},
+				hpack.HeaderField{Name: ":scheme", Value: req.URL.Scheme},
+			)
+		}
+		for _, hf := range OverridePseudoHeaders(pseudo, overrides) {
+			f(hf.Name, hf.Value)
+		}
+		// with its own :authority, the request's host is sent as a regular header
+		if hasHeaderField(overrides, ":authority") {
+			f("host", host)
 		}
 		if trailers != "" {
 			f("trailer", trailers)
@@ -1738,6 +2072,85 @@ func (cc *ClientConn) encodeHeaders(req *http.Request, addGzipHeader bool, trail
 	return cc.hbuf.Bytes(), nil
 }
 
+type pseudoHeadersKey struct{}
+
+// WithPseudoHeaders returns a context which, when used as the context of a
+// request sent with RoundTrip, overrides the request's pseudo-header
+// fields. Each field replaces the generated field of the same name, and
+// fields with any other name, such as unknown pseudo-headers, are added
+// after them. Overridden values are not validated, so :path can be
+// absolute-form, * or missing its leading slash. If :authority is
+// overridden, the request's host is also sent as a regular host header.
+func WithPseudoHeaders(ctx context.Context, fields []hpack.HeaderField) context.Context {
+	return context.WithValue(ctx, pseudoHeadersKey{}, fields)
+}
+
+// ContextPseudoHeaders returns the pseudo-header overrides set with
+// WithPseudoHeaders, if any.
+func ContextPseudoHeaders(ctx context.Context) []hpack.HeaderField {
+	fields, _ := ctx.Value(pseudoHeadersKey{}).([]hpack.HeaderField)
+	return fields
+}
+
+// OverridePseudoHeaders returns pseudo with each field replaced by the
+// override of the same name. Overrides with new names are appended.
+func OverridePseudoHeaders(pseudo, overrides []hpack.HeaderField) []hpack.HeaderField {
+	ret := append([]hpack.HeaderField(nil), pseudo...)
+	for _, o := range overrides {
+		replaced := false
+		for i := range ret {
+			if i < len(pseudo) && ret[i].Name == o.Name {
+				ret[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+func hasHeaderField(fields []hpack.HeaderField, name string) bool {
+	for _, hf := range fields {
+		if hf.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type rawHeadersKey struct{}
+
+// WithRawHeaders returns a context which, when used as the context of a
+// request sent with RoundTrip, replaces the request's header block with
+// exactly fields, in order. No pseudo-headers are added, names are not
+// lowercased, and nothing is validated or removed, so connection-specific
+// headers, duplicate pseudo-headers, and CR, LF or NUL in values are all
+// sent as is. The request's Host, Header and Trailer are ignored, however
+// its body is still sent.
+func WithRawHeaders(ctx context.Context, fields []hpack.HeaderField) context.Context {
+	return context.WithValue(ctx, rawHeadersKey{}, fields)
+}
+
+func contextRawHeaders(ctx context.Context) ([]hpack.HeaderField, bool) {
+	fields, ok := ctx.Value(rawHeadersKey{}).([]hpack.HeaderField)
+	return fields, ok
+}
+
+// encodeRawHeaders encodes fields verbatim.
+// requires cc.mu be held.
+func (cc *ClientConn) encodeRawHeaders(fields []hpack.HeaderField) []byte {
+	cc.hbuf.Reset()
+	for _, hf := range fields {
+		if VerboseLogs {
+			log.Printf("http2: Transport encoding raw header %q = %q", hf.Name, hf.Value)
+		}
+		cc.henc.WriteField(hf)
+	}
+	return cc.hbuf.Bytes()
+}
+
 // shouldSendReqContentLength reports whether the http2.Transport should send
 // a "content-length" request header. This logic is basically a copy of the net/http
 // transferWriter.shouldSendContentLength.
@@ -1801,18 +2214,24 @@ type resAndError struct {
 
 // requires cc.mu be held.
 func (cc *ClientConn) newStream() *clientStream {
+	cs := cc.newStreamWithID(cc.nextStreamID)
+	cc.nextStreamID += 2
+	return cs
+}
+
+// requires cc.mu be held.
+func (cc *ClientConn) newStreamWithID(id uint32) *clientStream {
 	cs := &clientStream{
 		cc:        cc,
-		ID:        cc.nextStreamID,
+		ID:        id,
 		resc:      make(chan resAndError, 1),
 		peerReset: make(chan struct{}),
 		done:      make(chan struct{}),
 	}
 	cs.flow.add(int32(cc.initialWindowSize))
 	cs.flow.setConnFlow(&cc.flow)
-	cs.inflow.add(transportDefaultStreamFlow)
+	cs.inflow.add(cc.streamFlow)
 	cs.inflow.setConnFlow(&cc.inflow)
-	cc.nextStreamID += 2
 	cc.streams[cs.ID] = cs
 	return cs
 }
@@ -1828,6 +2247,9 @@ func (cc *ClientConn) streamByID(id uint32, andRemove bool) *clientStream {
 	if andRemove && cs != nil && !cc.closed {
 		cc.lastActive = time.Now()
 		delete(cc.streams, id)
+		if id%2 == 0 {
+			cc.pushedStreams--
+		}
 		if len(cc.streams) == 0 && cc.idleTimer != nil {
 			cc.idleTimer.Reset(cc.idleTimeout)
 			cc.lastIdle = time.Now()
@@ -1953,6 +2375,9 @@ func (rl *clientConnReadLoop) run() error {
 		if VerboseLogs {
 			cc.vlogf("http2: Transport received %s", summarizeFrame(f))
 		}
+		if cc.t.FrameObserver != nil {
+			cc.observeRead(f)
+		}
 		if !gotSettings {
 			if _, ok := f.(*SettingsFrame); !ok {
 				cc.logf("protocol error: received %T before a SETTINGS frame", f)
@@ -1978,7 +2403,7 @@ func (rl *clientConnReadLoop) run() error {
 			maybeIdle = true
 		case *SettingsFrame:
 			err = rl.processSettings(f)
-		case *PushPromiseFrame:
+		case *MetaPushPromiseFrame:
 			err = rl.processPushPromise(f)
 		case *WindowUpdateFrame:
 			err = rl.processWindowUpdate(f)
@@ -2261,8 +2686,8 @@ func (b transportResponseBody) Read(p []byte) (n int, err error) {
 		// consumed by the client) when computing flow control for this
 		// stream.
 		v := int(cs.inflow.available()) + cs.bufPipe.Len()
-		if v < transportDefaultStreamFlow-transportDefaultStreamMinRefresh {
-			streamAdd = int32(transportDefaultStreamFlow - v)
+		if flow := int(cc.streamFlow); v < flow-transportDefaultStreamMinRefresh {
+			streamAdd = int32(flow - v)
 			cs.inflow.add(streamAdd)
 		}
 	}
@@ -2464,6 +2889,9 @@ func (rl *clientConnReadLoop) processSettings(f *SettingsFrame) error {
 	}
 
 	err := f.ForeachSetting(func(s Setting) error {
+		if !cc.gotServerSettings {
+			cc.serverSettings = append(cc.serverSettings, s)
+		}
 		switch s.ID {
 		case SettingMaxFrameSize:
 			cc.maxFrameSize = s.Val
@@ -2499,6 +2927,7 @@ func (rl *clientConnReadLoop) processSettings(f *SettingsFrame) error {
 	if err != nil {
 		return err
 	}
+	cc.gotServerSettings = true
 
 	cc.wmu.Lock()
 	defer cc.wmu.Unlock()
@@ -2611,15 +3040,123 @@ func (rl *clientConnReadLoop) processPing(f *PingFrame) error {
 	return cc.bw.Flush()
 }
 
-func (rl *clientConnReadLoop) processPushPromise(f *PushPromiseFrame) error {
-	// We told the peer we don't want them.
-	// Spec says:
-	// "PUSH_PROMISE MUST NOT be sent if the SETTINGS_ENABLE_PUSH
-	// setting of the peer endpoint is set to 0. An endpoint that
-	// has set this setting and has received acknowledgement MUST
-	// treat the receipt of a PUSH_PROMISE frame as a connection
-	// error (Section 5.4.1) of type PROTOCOL_ERROR."
-	return ConnectionError(ErrCodeProtocol)
+// PushPromise is a request promised by the server with a PUSH_PROMISE
+// frame.
+type PushPromise struct {
+	StreamID         uint32 // the stream the promise was sent on
+	PromisedStreamID uint32
+
+	// Associated is the request on StreamID, or nil if the stream
+	// has already closed.
+	Associated *http.Request
+
+	// Fields are the header fields of the promised request, as sent.
+	Fields []hpack.HeaderField
+
+	// Request is the promised request, built from Fields.
+	Request *http.Request
+}
+
+// PushHandler receives server pushes.
+type PushHandler interface {
+	// HandlePush is called in its own goroutine once the response
+	// headers of the pushed stream arrive, or with an error if the
+	// stream fails first. The response body is closed once HandlePush
+	// returns.
+	HandlePush(push *PushPromise, res *http.Response, err error)
+}
+
+// PushHandlerFunc is an adapter to allow a function to be used as a
+// PushHandler.
+type PushHandlerFunc func(push *PushPromise, res *http.Response, err error)
+
+func (f PushHandlerFunc) HandlePush(push *PushPromise, res *http.Response, err error) {
+	f(push, res, err)
+}
+
+func (rl *clientConnReadLoop) processPushPromise(f *MetaPushPromiseFrame) error {
+	cc := rl.cc
+	if cc.t.PushHandler == nil {
+		// We told the peer we don't want them.
+		// Spec says:
+		// "PUSH_PROMISE MUST NOT be sent if the SETTINGS_ENABLE_PUSH
+		// setting of the peer endpoint is set to 0. An endpoint that
+		// has set this setting and has received acknowledgement MUST
+		// treat the receipt of a PUSH_PROMISE frame as a connection
+		// error (Section 5.4.1) of type PROTOCOL_ERROR."
+		return ConnectionError(ErrCodeProtocol)
+	}
+	// Promised streams are always server initiated, so even.
+	if f.PromiseID == 0 || f.PromiseID%2 != 0 {
+		return ConnectionError(ErrCodeProtocol)
+	}
+
+	push := &PushPromise{
+		StreamID:         f.StreamID,
+		PromisedStreamID: f.PromiseID,
+		Fields:           append([]hpack.HeaderField(nil), f.Fields...),
+	}
+	push.Request = pushedRequest(push.Fields)
+
+	cc.mu.Lock()
+	if _, ok := cc.streams[f.PromiseID]; ok {
+		cc.mu.Unlock()
+		return ConnectionError(ErrCodeProtocol)
+	}
+	if assoc := cc.streams[f.StreamID]; assoc != nil {
+		push.Associated = assoc.req
+	}
+	cs := cc.newStreamWithID(f.PromiseID)
+	cs.req = push.Request
+	cc.pushedStreams++
+	cc.mu.Unlock()
+
+	go cs.awaitPush(push, cc.t.PushHandler)
+	return nil
+}
+
+// awaitPush waits for the response to the pushed stream and passes it
+// to h.
+func (cs *clientStream) awaitPush(push *PushPromise, h PushHandler) {
+	re := <-cs.resc
+	h.HandlePush(push, re.res, re.err)
+	if re.res != nil {
+		re.res.Body.Close()
+	}
+}
+
+// pushedRequest returns the request promised by fields.
+func pushedRequest(fields []hpack.HeaderField) *http.Request {
+	req := &http.Request{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		URL:        &url.URL{},
+	}
+	var path string
+	for _, hf := range fields {
+		switch hf.Name {
+		case ":method":
+			req.Method = hf.Value
+		case ":scheme":
+			req.URL.Scheme = hf.Value
+		case ":authority":
+			req.URL.Host = hf.Value
+			req.Host = hf.Value
+		case ":path":
+			path = hf.Value
+		default:
+			if !strings.HasPrefix(hf.Name, ":") {
+				req.Header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+			}
+		}
+	}
+	if u, err := url.ParseRequestURI(path); err == nil {
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	} else {
+		req.URL.Path = path
+	}
+	return req
 }
 
 func (cc *ClientConn) writeStreamReset(streamID uint32, code ErrCode, err error) {
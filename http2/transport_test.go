@@ -4732,3 +4732,95 @@ func TestClientConnTooIdle(t *testing.T) {
 		}
 	}
 }
+
+func TestTransportPushedStreamsDontCountTowardsLimit(t *testing.T) {
+	testTransportPushedStreamsDontCountTowardsLimit(t, false)
+}
+func TestTransportPushedStreamsDontCountTowardsLimit_Strict(t *testing.T) {
+	testTransportPushedStreamsDontCountTowardsLimit(t, true)
+}
+
+// tests that a pending pushed stream doesn't take a slot allowed by
+// SETTINGS_MAX_CONCURRENT_STREAMS.
+func testTransportPushedStreamsDontCountTowardsLimit(t *testing.T, strict bool) {
+	clientDone := make(chan struct{})
+	ct := newClientTester(t)
+	ct.tr.StrictMaxConcurrentStreams = strict
+	ct.tr.PushHandler = PushHandlerFunc(func(*PushPromise, *http.Response, error) {})
+	ct.client = func() error {
+		defer func() {
+			close(clientDone)
+			ct.cc.(*net.TCPConn).CloseWrite()
+			if runtime.GOOS == "plan9" {
+				// CloseWrite not supported on Plan 9; Issue 17906
+				ct.cc.(*net.TCPConn).Close()
+			}
+		}()
+		for k := 0; k < 2; k++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			req, _ := http.NewRequest("GET", fmt.Sprintf("https://dummy.tld/%d", k), nil)
+			res, err := ct.tr.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				cancel()
+				return fmt.Errorf("RoundTrip(%d): %v", k, err)
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			cancel()
+		}
+		return nil
+	}
+	ct.server = func() error {
+		// Without StrictMaxConcurrentStreams a conn only takes a request
+		// while another slot would remain.
+		maxConcurrent := uint32(2)
+		if strict {
+			maxConcurrent = 1
+		}
+		ct.greet(Setting{SettingMaxConcurrentStreams, maxConcurrent})
+
+		var buf bytes.Buffer
+		enc := hpack.NewEncoder(&buf)
+		for {
+			f, err := ct.fr.ReadFrame()
+			if err != nil {
+				select {
+				case <-clientDone:
+					return nil
+				default:
+					return err
+				}
+			}
+			hf, ok := f.(*HeadersFrame)
+			if !ok {
+				continue
+			}
+			if hf.StreamID == 1 {
+				// Promise a stream that is never completed.
+				buf.Reset()
+				enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+				enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+				enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "dummy.tld"})
+				enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/pushed"})
+				ct.fr.WritePushPromise(PushPromiseParam{
+					StreamID:      1,
+					PromiseID:     2,
+					EndHeaders:    true,
+					BlockFragment: buf.Bytes(),
+				})
+			}
+			buf.Reset()
+			enc.WriteField(hpack.HeaderField{Name: ":status", Value: "204"})
+			ct.fr.WriteHeaders(HeadersFrameParam{
+				StreamID:      hf.StreamID,
+				EndHeaders:    true,
+				EndStream:     true,
+				BlockFragment: buf.Bytes(),
+			})
+			if hf.StreamID == 3 {
+				ct.fr.WriteRSTStream(2, ErrCodeCancel)
+			}
+		}
+	}
+	ct.run()
+}
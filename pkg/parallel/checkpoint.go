@@ -0,0 +1,218 @@
+package parallel
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/assetnote/h2csmuggler"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointEntry is the record of a completed target in a checkpoint file
+type CheckpointEntry struct {
+	Target string    `json:"target"`
+	Mode   string    `json:"mode,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Body   int       `json:"body,omitempty"` // the length of the response body
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// Reason classifies the error. See h2csmuggler.UpgradeErrorKind
+	Reason h2csmuggler.UpgradeErrorKind `json:"reason,omitempty"`
+
+	// Differs is set for the targets of GetPathDiffOnHost, with the h2c response recorded
+	// in the other fields
+	Differs *bool `json:"differs,omitempty"`
+}
+
+// retryReasons are the failures which may have been caused by the scanner losing its network
+// rather than by the target. Targets which failed with these are retried when resuming
+var retryReasons = map[h2csmuggler.UpgradeErrorKind]bool{
+	h2csmuggler.KindDNS:     true,
+	h2csmuggler.KindRefused: true,
+	h2csmuggler.KindConnect: true,
+	h2csmuggler.KindTimeout: true,
+	h2csmuggler.KindClosed:  true,
+}
+
+// The modes recorded for the targets of GetUpgradeMatrix and ProbeDesync
+const (
+	modeMatrix = "matrix"
+	modeDesync = "desync"
+)
+
+// Checkpoint records the targets completed by a Client to a file, one json CheckpointEntry
+// per line. Targets are recorded separately for each mode they are requested with, such as
+// the upgrade and prior knowledge checks of GetParallelHosts. When resumed, the modes of the
+// targets recorded by the previous run are skipped, unless they failed for a reason in
+// retryReasons. The file is appended to as each target completes, so progress survives the
+// process being killed. A nil *Checkpoint records nothing and skips nothing. Checkpoint is
+// safe for concurrent use
+type Checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	done map[checkpointKey]struct{}
+}
+
+// checkpointKey identifies a target requested with a mode
+type checkpointKey struct {
+	target string
+	mode   string
+}
+
+// OpenCheckpoint will open the checkpoint file at path, creating it if it doesn't exist. If
+// resume is set, the targets already recorded in the file are loaded and new entries are
+// appended. Otherwise the file is truncated. A checkpoint should only be resumed by the
+// same command with the same arguments, as targets are recorded without the options they
+// were requested with
+func OpenCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	cp := &Checkpoint{done: make(map[checkpointKey]struct{})}
+	flags := os.O_CREATE | os.O_RDWR
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open checkpoint")
+	}
+	cp.file = f
+	if !resume {
+		return cp, nil
+	}
+
+	if err := cp.load(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to load checkpoint")
+	}
+	return cp, nil
+}
+
+// load will read the completed targets from the file, leaving it positioned at the end for
+// new entries
+func (cp *Checkpoint) load() error {
+	r := bufio.NewReader(cp.file)
+	last := byte('\n')
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			last = line[len(line)-1]
+			var e CheckpointEntry
+			if jerr := jsoniter.ConfigFastest.Unmarshal(line, &e); jerr != nil || e.Target == "" {
+				// the previous run may have been killed part way through writing an entry
+				log.WithField("entry", string(line)).Warnf("skipping invalid checkpoint entry")
+			} else if !retryReasons[e.Reason] {
+				cp.done[checkpointKey{e.Target, e.Mode}] = struct{}{}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := cp.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	// terminate a partially written entry, so that it doesn't corrupt the next one
+	if last != '\n' {
+		if _, err := cp.file.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	log.WithField("completed", len(cp.done)).Infof("resuming from checkpoint")
+	return nil
+}
+
+// Done will return whether the target was completed with the mode by a previous run. The
+// mode is the Mode of the target's Result, which is empty for the methods which don't set
+// one, or matrix and desync for GetUpgradeMatrix and ProbeDesync
+func (cp *Checkpoint) Done(target string, mode string) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.done[checkpointKey{target, mode}]
+	return ok
+}
+
+// Record will record the result of a target as completed
+func (cp *Checkpoint) Record(r *Result) {
+	if cp == nil {
+		return
+	}
+	e := CheckpointEntry{Target: r.Target, Mode: r.Mode}
+	setResult(&e, r)
+	cp.write(e)
+}
+
+// RecordDiff will record the target of the diff as completed
+func (cp *Checkpoint) RecordDiff(d *DiffResult) {
+	if cp == nil {
+		return
+	}
+	differs := d.Differs
+	e := CheckpointEntry{Target: d.Target, Differs: &differs}
+	if d.H2C != nil {
+		setResult(&e, d.H2C)
+	}
+	cp.write(e)
+}
+
+// recordTarget will record the target as completed by the mode, e.g. the upgrade matrix
+func (cp *Checkpoint) recordTarget(target string, mode string, err error) {
+	if cp == nil {
+		return
+	}
+	e := CheckpointEntry{Target: target, Mode: mode}
+	if err != nil {
+		e.Error = err.Error()
+		e.Reason = failureReason(err)
+	}
+	cp.write(e)
+}
+
+// setResult will copy the outcome of the result to the entry
+func setResult(e *CheckpointEntry, r *Result) {
+	if r.Err != nil {
+		e.Error = r.Err.Error()
+		e.Reason = failureReason(r.Err)
+	}
+	if r.Response != nil {
+		e.Status = r.Response.StatusCode
+		e.Body = len(r.Body)
+	}
+}
+
+// write will append the entry to the file. Failures are logged rather than stopping the run
+func (cp *Checkpoint) write(e CheckpointEntry) {
+	e.Time = time.Now()
+	line, err := jsoniter.ConfigFastest.Marshal(e)
+	if err != nil {
+		log.WithField("target", e.Target).WithError(err).Errorf("failed to record checkpoint")
+		return
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	// a single write per entry, so an entry is either fully written or cut short at the end
+	if _, err := cp.file.Write(append(line, '\n')); err != nil {
+		log.WithField("target", e.Target).WithError(err).Errorf("failed to record checkpoint")
+	}
+}
+
+// Close will close the checkpoint file
+func (cp *Checkpoint) Close() error {
+	if cp == nil {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.file.Close()
+}
@@ -0,0 +1,161 @@
+package parallel
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/assetnote/h2csmuggler"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.jsonl")
+
+	cp, err := OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Record(&Result{Target: "http://a.com/", Response: &http.Response{StatusCode: 200}, Body: []byte("ok")})
+	cp.Record(&Result{Target: "http://b.com/", Err: &h2csmuggler.UpgradeError{Kind: h2csmuggler.KindStatus, Err: errors.New("403")}})
+	cp.Record(&Result{Target: "http://d.com/", Err: &h2csmuggler.UpgradeError{Kind: h2csmuggler.KindTimeout, Err: errors.New("timeout")}})
+	if cp.Done("http://a.com/", "") {
+		t.Errorf("got a target recorded by this run as done, want only previous runs")
+	}
+	cp.Close()
+
+	// simulate the run being killed part way through writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"target":"http://c.com/","sta`))
+	f.Close()
+
+	cp, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]bool{
+		"http://a.com/": true,
+		"http://b.com/": true,
+		"http://c.com/": false, // only partially written
+		"http://d.com/": false, // may have timed out because the network was lost
+	} {
+		if got := cp.Done(target, ""); got != want {
+			t.Errorf("Done(%q) = %v, want %v", target, got, want)
+		}
+	}
+	cp.Record(&Result{Target: "http://c.com/", Response: &http.Response{StatusCode: 404}})
+	cp.Close()
+
+	cp, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	if !cp.Done("http://c.com/", "") {
+		t.Errorf("got the entry after the partial entry lost, want it recorded")
+	}
+
+	state, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(state), "\n"); lines != 5 {
+		t.Errorf("got %d lines, want 5 including the partial entry:\n%s", lines, state)
+	}
+}
+
+func TestClient_Checkpoint(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.jsonl")
+
+	run := func(resume bool, targets ...string) []string {
+		cp, err := OpenCheckpoint(path, resume)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cp.Close()
+
+		var requested []string
+		c := New()
+		c.Checkpoint = cp
+		c.ResultHandler = ResultHandlerFunc(func(r *Result) {
+			requested = append(requested, r.Target)
+		})
+		if err := c.GetPathsOnHost(s.URL, targets); err != nil {
+			t.Fatal(err)
+		}
+		return requested
+	}
+
+	run(false, s.URL+"/a")
+	if got := run(true, s.URL+"/a", s.URL+"/b"); len(got) != 1 || got[0] != s.URL+"/b" {
+		t.Errorf("resumed run requested %v, want only /b", got)
+	}
+	if got := run(false, s.URL+"/a"); len(got) != 1 {
+		t.Errorf("fresh run requested %v, want /a again", got)
+	}
+}
+
+func TestCheckpointModes(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.jsonl")
+
+	// simulate a run killed between the upgrade and prior knowledge checks of /a, after the
+	// prior knowledge check of /b failed to connect
+	cp, err := OpenCheckpoint(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Record(&Result{Target: s.URL + "/a", Mode: ModeUpgrade, Response: &http.Response{StatusCode: 200}})
+	cp.Record(&Result{Target: s.URL + "/b", Mode: ModeUpgrade, Response: &http.Response{StatusCode: 200}})
+	cp.Record(&Result{Target: s.URL + "/b", Mode: ModePriorKnowledge, Err: &h2csmuggler.UpgradeError{Kind: h2csmuggler.KindRefused, Err: errors.New("refused")}})
+	cp.Close()
+
+	cp, err = OpenCheckpoint(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	var requested []string
+	c := New()
+	c.PriorKnowledge = true
+	c.Checkpoint = cp
+	c.ResultHandler = ResultHandlerFunc(func(r *Result) {
+		requested = append(requested, r.Mode+" "+strings.TrimPrefix(r.Target, s.URL))
+	})
+	if err := c.GetParallelHosts([]string{s.URL + "/a", s.URL + "/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(requested)
+	if want := []string{"prior-knowledge /a", "prior-knowledge /b"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("resumed run requested %v, want %v", requested, want)
+	}
+}
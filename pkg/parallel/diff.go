@@ -3,80 +3,107 @@ package parallel
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 
 	"github.com/assetnote/h2csmuggler/http2"
 	jsoniter "github.com/json-iterator/go"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-type res struct {
-	target string
-	res    *http.Response // response.Body is already read and closed and stored on body
-	body   []byte
-	err    error
-}
-
-func (r *res) IsNil() bool {
-	return r.err == nil && r.res == nil
-}
-
-func (r *res) Log(source string, PrettyPrint bool) {
-	if r.err != nil {
-		var uscErr http2.UnexpectedStatusCodeError
-		if errors.As(r.err, &uscErr) {
-			log.WithFields(log.Fields{
-				"status": uscErr.Code,
-				"target": r.target,
-				"source": source,
-			}).Errorf("unexpected status code")
-		} else {
-			log.WithField("target", r.target).WithError(r.err).Errorf("failed")
+// logPush will return a push handler which logs each server push in the same format as the
+// results
+func logPush(PrettyPrint bool) http2.PushHandler {
+	return http2.PushHandlerFunc(func(push *http2.PushPromise, res *http.Response, err error) {
+		fields := log.Fields{
+			"target": push.Request.URL.String(),
+			"source": "push",
+		}
+		if push.Associated != nil {
+			fields["pushed_by"] = push.Associated.URL.String()
+		}
+		if err != nil {
+			log.WithFields(fields).WithError(err).Errorf("push failed")
+			return
 		}
-	} else {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			log.WithFields(fields).WithError(err).Errorf("push failed")
+			return
+		}
+
 		if PrettyPrint {
-			fmt.Printf("[H2C Smuggling detected on %s]\n", r.target)
-			if r.err == nil {
-				fmt.Println("[Smuggled response]")
-				httpr, err := httputil.DumpResponse(r.res, false)
-				if err != nil {
-					log.WithError(err).Errorf("failed to dump h2c rponse")
-				}
-				fmt.Printf("%s", string(httpr))
-				if log.GetLevel() != log.InfoLevel {
-					fmt.Println(string(r.body))
-				} else {
-					fmt.Printf("[Response Body: %d bytes]\n", len(r.body))
-				}
+			fmt.Printf("[Server push of %s]\n", fields["target"])
+			if push.Associated != nil {
+				fmt.Printf("[Pushed with %s]\n", fields["pushed_by"])
+			}
+			fmt.Println("[Promised request]")
+			httpr, err := httputil.DumpRequest(push.Request, false)
+			if err != nil {
+				log.WithError(err).Errorf("failed to dump pushed request")
+			}
+			fmt.Printf("%s", string(httpr))
+			fmt.Println("[Pushed response]")
+			httpr, err = httputil.DumpResponse(res, false)
+			if err != nil {
+				log.WithError(err).Errorf("failed to dump pushed response")
+			}
+			fmt.Printf("%s", string(httpr))
+			if log.GetLevel() != log.InfoLevel {
+				fmt.Println(string(body))
 			} else {
-				fmt.Println("[Smuggled Error]")
-				fmt.Println(r.err)
-				fmt.Println()
+				fmt.Printf("[Response Body: %d bytes]\n", len(body))
 			}
-
-		} else {
-			log.WithFields(log.Fields{
-				"status":  r.res.StatusCode,
-				"headers": r.res.Header,
-				"body":    len(r.body),
-				"target":  r.target,
-				"source":  source,
-			}).Infof("success")
+			return
 		}
-	}
+
+		fields["status"] = res.StatusCode
+		fields["headers"] = res.Header
+		fields["body"] = len(body)
+		fields["request_headers"] = push.Request.Header
+		log.WithFields(fields).Infof("server push")
+	})
 }
 
 type Diff struct {
-	HTTP2 *res
-	H2C   *res
+	HTTP2 *Result
+	H2C   *Result
+}
+
+// DiffResult is the comparison of the results of requesting a target over http2 and h2c
+type DiffResult struct {
+	Target string
+	HTTP2  *Result
+	H2C    *Result
+
+	// Differs is whether the responses differ in their error, status code, number of
+	// headers or body length
+	Differs bool
+
+	// State holds the differences between the responses. Fields which are the same are left
+	// empty, except the bodies which are set whenever they differ
+	State DiffState
 }
 
+// DiffHandler receives the comparison of each target requested by GetPathDiffOnHost
+type DiffHandler interface {
+	HandleDiff(d *DiffResult)
+}
+
+// DiffHandlerFunc is an adapter to allow a function to be used as a DiffHandler
+type DiffHandlerFunc func(d *DiffResult)
+
+func (f DiffHandlerFunc) HandleDiff(d *DiffResult) { f(d) }
+
 type ResponseDiff struct {
 	cache        map[string]*Diff
 	DeleteOnShow bool // if enabled, results will be cleared from the cache once shown
 	PrettyPrint  bool // print the diff prettily
+
+	// Handler receives each completed diff. If nil, diffs which differ are logged with
+	// LogDiffs(PrettyPrint)
+	Handler DiffHandler
 }
 
 func NewDiffer(DeleteOnShow bool) *ResponseDiff {
@@ -88,22 +115,22 @@ func NewDiffer(DeleteOnShow bool) *ResponseDiff {
 
 // ShowDiffH2C will show if there's a diff between the http2 and h2c responses.
 // if the corresponding response is not cached, this does nothing
-func (r *ResponseDiff) ShowDiffH2C(http2res *res) {
+func (r *ResponseDiff) ShowDiffH2C(http2res *Result) {
 	d := r.diffH2C(http2res)
 	if d.H2C == nil || d.HTTP2 == nil {
 		return
 	}
-	r.diffHosts(d)
+	r.show(d)
 }
 
 // ShowDiffHTTP2 will show if there's a diff between the http2 and h2c responses.
 // if the corresponding response is not cached, this does nothing
-func (r *ResponseDiff) ShowDiffHTTP2(http2res *res) {
+func (r *ResponseDiff) ShowDiffHTTP2(http2res *Result) {
 	d := r.diffHTTP2(http2res)
 	if d.H2C == nil || d.HTTP2 == nil {
 		return
 	}
-	r.diffHosts(d)
+	r.show(d)
 }
 
 type State struct {
@@ -152,46 +179,57 @@ func (d DiffState) Map() map[string]interface{} {
 	}
 }
 
-func (r *ResponseDiff) diffHosts(d *Diff) {
+// show will compare the completed diff and pass it to the handler
+func (r *ResponseDiff) show(d *Diff) {
 	log.Tracef("got d: %+v", d)
 	log.Tracef("r is :%+v", r)
-	diff := false
-	fields := log.Fields{}
-	debugFields := log.Fields{}
+	h := r.Handler
+	if h == nil {
+		h = LogDiffs(r.PrettyPrint)
+	}
+	h.HandleDiff(compare(d))
 
+	if r.DeleteOnShow {
+		delete(r.cache, d.HTTP2.Target)
+	}
+}
+
+// compare will return the differences between the http2 and h2c results of the diff
+func compare(d *Diff) *DiffResult {
+	diff := false
 	var res DiffState
 
-	if d.HTTP2.err != d.H2C.err {
+	if d.HTTP2.Err != d.H2C.Err {
 		diff = true
-		if d.H2C.err != nil {
-			res.Normal.StatusCode = d.HTTP2.res.StatusCode
-			res.Normal.ResponseBodyLength = len(d.HTTP2.body)
-			res.Host = d.HTTP2.res.Request.Host
-			res.H2C.Error = d.H2C.err
+		if d.H2C.Err != nil {
+			res.Normal.StatusCode = d.HTTP2.Response.StatusCode
+			res.Normal.ResponseBodyLength = len(d.HTTP2.Body)
+			res.Host = d.HTTP2.Response.Request.Host
+			res.H2C.Error = d.H2C.Err
 		}
-		if d.HTTP2.err != nil {
-			res.H2C.StatusCode = d.H2C.res.StatusCode
-			res.H2C.ResponseBodyLength = len(d.H2C.body)
-			res.Host = d.H2C.res.Request.Host
-			res.Normal.Error = d.HTTP2.err
+		if d.HTTP2.Err != nil {
+			res.H2C.StatusCode = d.H2C.Response.StatusCode
+			res.H2C.ResponseBodyLength = len(d.H2C.Body)
+			res.Host = d.H2C.Response.Request.Host
+			res.Normal.Error = d.HTTP2.Err
 		}
 	}
-	if d.HTTP2.res != nil && d.H2C.res != nil {
-		res.Host = d.H2C.res.Request.Host
-		if d.HTTP2.res.StatusCode != d.H2C.res.StatusCode {
+	if d.HTTP2.Response != nil && d.H2C.Response != nil {
+		res.Host = d.H2C.Response.Request.Host
+		if d.HTTP2.Response.StatusCode != d.H2C.Response.StatusCode {
 			diff = true
-			res.Normal.StatusCode = d.HTTP2.res.StatusCode
-			res.H2C.StatusCode = d.H2C.res.StatusCode
+			res.Normal.StatusCode = d.HTTP2.Response.StatusCode
+			res.H2C.StatusCode = d.H2C.Response.StatusCode
 		}
 
-		if len(d.HTTP2.res.Header) != len(d.H2C.res.Header) {
+		if len(d.HTTP2.Response.Header) != len(d.H2C.Response.Header) {
 			diff = true
 			sharedHeaders := http.Header{}
 			http2Headers := http.Header{}
 			h2cHeaders := http.Header{}
 			seen := map[string]struct{}{}
-			for k, v := range d.HTTP2.res.Header {
-				h2cv := d.H2C.res.Header.Values(k)
+			for k, v := range d.HTTP2.Response.Header {
+				h2cv := d.H2C.Response.Header.Values(k)
 				if len(v) != len(h2cv) {
 					for _, vv := range v {
 						http2Headers.Add(k, vv)
@@ -207,7 +245,7 @@ func (r *ResponseDiff) diffHosts(d *Diff) {
 				seen[k] = struct{}{}
 			}
 
-			for k, v := range d.H2C.res.Header {
+			for k, v := range d.H2C.Response.Header {
 				_, ok := seen[k]
 				if ok {
 					continue
@@ -222,69 +260,89 @@ func (r *ResponseDiff) diffHosts(d *Diff) {
 			res.H2C.Headers = h2cHeaders
 		}
 
-		if len(d.HTTP2.body) != len(d.H2C.body) {
+		if len(d.HTTP2.Body) != len(d.H2C.Body) {
 			diff = true
-			res.Normal.ResponseBodyLength = len(d.HTTP2.body)
-			res.H2C.ResponseBodyLength = len(d.H2C.body)
+			res.Normal.ResponseBodyLength = len(d.HTTP2.Body)
+			res.H2C.ResponseBodyLength = len(d.H2C.Body)
 		}
 
-		if bytes.Compare(d.HTTP2.body, d.H2C.body) != 0 {
-			res.Normal.Body = string(d.HTTP2.body)
-			debugFields["normal-body"] = res.Normal.Body
-			res.H2C.Body = string(d.H2C.body)
-			debugFields["h2c-body"] = res.H2C.Body
+		if bytes.Compare(d.HTTP2.Body, d.H2C.Body) != 0 {
+			res.Normal.Body = string(d.HTTP2.Body)
+			res.H2C.Body = string(d.H2C.Body)
 		}
 	}
 
-	for k, v := range res.Map() {
-		if v == nil {
-			continue
+	return &DiffResult{
+		Target:  d.HTTP2.Target,
+		HTTP2:   d.HTTP2,
+		H2C:     d.H2C,
+		Differs: diff,
+		State:   res,
+	}
+}
+
+// LogDiffs will return a handler which logs each diff where the responses differ, or prints
+// it if pretty is set
+func LogDiffs(pretty bool) DiffHandler {
+	return DiffHandlerFunc(func(d *DiffResult) {
+		res := d.State
+		fields := log.Fields{}
+		debugFields := log.Fields{}
+		if res.Normal.Body != "" || res.H2C.Body != "" {
+			debugFields["normal-body"] = res.Normal.Body
+			debugFields["h2c-body"] = res.H2C.Body
 		}
-		if vv, ok := v.(http.Header); ok && len(vv) == 0 {
-			continue
+		for k, v := range res.Map() {
+			if v == nil {
+				continue
+			}
+			if vv, ok := v.(http.Header); ok && len(vv) == 0 {
+				continue
+			}
+			fields[k] = v
 		}
-		fields[k] = v
-	}
 
-	log.WithFields(fields).Tracef("Diff: %v", diff)
-	if diff {
-		log.Tracef("printing results: pretty(%v)", r.PrettyPrint)
-		if r.PrettyPrint {
+		log.WithFields(fields).Tracef("Diff: %v", d.Differs)
+		if !d.Differs {
+			return
+		}
+		log.Tracef("printing results: pretty(%v)", pretty)
+		if pretty {
 			fmt.Printf("[H2C Smuggling detected on %s]\n", res.Host)
-			if d.H2C.err == nil {
+			if d.H2C.Err == nil {
 				fmt.Println("[Smuggled Response]")
-				r, err := httputil.DumpResponse(d.H2C.res, false)
+				r, err := httputil.DumpResponse(d.H2C.Response, false)
 				if err != nil {
 					log.WithError(err).Errorf("failed to dump h2c response")
 				}
 				fmt.Printf("%s", string(r))
 				if log.GetLevel() != log.InfoLevel {
-					fmt.Println(string(d.H2C.body))
+					fmt.Println(string(d.H2C.Body))
 				} else {
-					fmt.Printf("[Smuggled response body: %d bytes]\n", len(string(d.H2C.body)))
+					fmt.Printf("[Smuggled response body: %d bytes]\n", len(string(d.H2C.Body)))
 				}
 				fmt.Println()
 			} else {
 				fmt.Println("[Smuggled Error]")
-				fmt.Println(d.H2C.err)
+				fmt.Println(d.H2C.Err)
 				fmt.Println()
 			}
 
-			if d.HTTP2.err == nil {
+			if d.HTTP2.Err == nil {
 				fmt.Println("[Normal Response]")
-				r, err := httputil.DumpResponse(d.HTTP2.res, false)
+				r, err := httputil.DumpResponse(d.HTTP2.Response, false)
 				if err != nil {
 					log.WithError(err).Errorf("failed to dump h2c response")
 				}
 				fmt.Printf("%s", string(r))
 				if log.GetLevel() != log.InfoLevel {
-					fmt.Println(string(d.HTTP2.body))
+					fmt.Println(string(d.HTTP2.Body))
 				} else {
-					fmt.Printf("[Smuggled response body: %d bytes]\n", len(string(d.HTTP2.body)))
+					fmt.Printf("[Smuggled response body: %d bytes]\n", len(string(d.HTTP2.Body)))
 				}
 			} else {
 				fmt.Println("[Normal Error]")
-				fmt.Println(d.HTTP2.err)
+				fmt.Println(d.HTTP2.Err)
 			}
 
 		} else {
@@ -295,30 +353,26 @@ func (r *ResponseDiff) diffHosts(d *Diff) {
 				log.WithFields(fields).WithFields(debugFields).Debugf("results differ")
 			}
 		}
-	}
-
-	if r.DeleteOnShow {
-		delete(r.cache, d.HTTP2.target)
-	}
+	})
 }
 
 // DiffHTTP2 will return the diff, with the provided argument as the http2 result
-func (r *ResponseDiff) diffHTTP2(http2res *res) (d *Diff) {
-	diff, ok := r.cache[http2res.target]
+func (r *ResponseDiff) diffHTTP2(http2res *Result) (d *Diff) {
+	diff, ok := r.cache[http2res.Target]
 	if !ok {
-		r.cache[http2res.target] = &Diff{}
-		diff = r.cache[http2res.target]
+		r.cache[http2res.Target] = &Diff{}
+		diff = r.cache[http2res.Target]
 	}
 	diff.HTTP2 = http2res
 	return diff
 }
 
 // DiffH2C will return the diff, with the provided argument as the http2 result
-func (r *ResponseDiff) diffH2C(h2cres *res) (d *Diff) {
-	diff, ok := r.cache[h2cres.target]
+func (r *ResponseDiff) diffH2C(h2cres *Result) (d *Diff) {
+	diff, ok := r.cache[h2cres.Target]
 	if !ok {
-		r.cache[h2cres.target] = &Diff{}
-		diff = r.cache[h2cres.target]
+		r.cache[h2cres.Target] = &Diff{}
+		diff = r.cache[h2cres.Target]
 	}
 	diff.H2C = h2cres
 	return diff
@@ -0,0 +1,289 @@
+package parallel
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimiter spaces out operations so that at most perSecond are started each second.
+// There is no burst, each operation waits for the interval after the previous one.
+// rateLimiter satisfies h2csmuggler.Limiter
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // when the next operation may start
+}
+
+// newRateLimiter will return a limiter for perSecond operations a second, or nil if
+// perSecond is not positive
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait will block until the next operation may start. The slot is reserved even if ctx is
+// done before it is reached
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	return sleep(ctx, l.reserve())
+}
+
+// reserve will reserve the next slot, returning how long to wait for it
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	return at.Sub(now)
+}
+
+// idle will return whether the next operation may start immediately, in which case the
+// limiter is equivalent to a new one
+func (l *rateLimiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.next.After(now)
+}
+
+// limiterFunc is an adapter to allow a function to be used as a h2csmuggler.Limiter
+type limiterFunc func(ctx context.Context) error
+
+func (f limiterFunc) Wait(ctx context.Context) error { return f(ctx) }
+
+// sleep will wait for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limits applies the client's rate limits to the requests it sends
+type limits struct {
+	global   *rateLimiter // all requests
+	upgrades *rateLimiter // new tunnels
+	hostRate float64
+	jitter   time.Duration
+	coolDown time.Duration
+	maxAfter time.Duration // the longest Retry-After which is honoured
+
+	mu       sync.Mutex
+	hosts    map[string]*rateLimiter
+	cooling  map[string]time.Time // host to when requests may resume
+	swept    int                  // the number of hosts and cool-downs after the last sweep
+	jitterMu sync.Mutex
+	rand     *rand.Rand
+}
+
+// limits will return the client's limits, creating them from its fields on first use
+func (c *Client) limits() *limits {
+	c.limitsOnce.Do(func() {
+		maxAfter := c.MaxCoolDown
+		if maxAfter == 0 {
+			maxAfter = DefaultMaxCoolDown
+		}
+		c.rateLimits = &limits{
+			global:   newRateLimiter(c.RequestsPerSecond),
+			upgrades: newRateLimiter(c.UpgradesPerSecond),
+			hostRate: c.HostRequestsPerSecond,
+			jitter:   c.Jitter,
+			coolDown: c.CoolDown,
+			maxAfter: maxAfter,
+			hosts:    make(map[string]*rateLimiter),
+			cooling:  make(map[string]time.Time),
+			rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	})
+	return c.rateLimits
+}
+
+// limit will wait for the client's limits before fn requests the target, then start a
+// cool-down if the response asks for one
+func (c *Client) limit(target string, fn func() (*Result, error)) (*Result, error) {
+	l := c.limits()
+	if err := l.wait(context.Background(), target); err != nil {
+		return &Result{Target: target}, err
+	}
+	r, err := fn()
+	l.observe(r)
+	return r, err
+}
+
+// wait will block until a request may be sent to the target. This waits for any cool-down
+// of the target's host, then its host and global rate limits, then a random jitter
+func (l *limits) wait(ctx context.Context, target string) error {
+	host := targetHost(target)
+	for {
+		l.mu.Lock()
+		until, ok := l.cooling[host]
+		expired := time.Now().After(until)
+		if ok && expired {
+			delete(l.cooling, host)
+		}
+		l.mu.Unlock()
+		// the cool-down may have been extended while waiting
+		if expired {
+			break
+		}
+		if err := sleep(ctx, time.Until(until)); err != nil {
+			return err
+		}
+	}
+
+	if err := sleep(ctx, l.reserveHost(host)); err != nil {
+		return err
+	}
+	if l.global != nil {
+		if err := l.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l.jitter > 0 {
+		l.jitterMu.Lock()
+		d := time.Duration(l.rand.Int63n(int64(l.jitter)))
+		l.jitterMu.Unlock()
+		return sleep(ctx, d)
+	}
+	return nil
+}
+
+// reserveHost will reserve the next slot of the host's rate limiter, returning how long to
+// wait for it. The slot is reserved with the lock held, so that the limiter can't be swept
+// in between
+func (l *limits) reserveHost(host string) time.Duration {
+	if l.hostRate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		l.sweep()
+		h = newRateLimiter(l.hostRate)
+		l.hosts[host] = h
+	}
+	return h.reserve()
+}
+
+// sweep will remove the idle host limiters and expired cool-downs, so that streaming many
+// hosts doesn't grow the maps without bound. This only runs once the maps have doubled in
+// size since the last sweep, so the cost is spread across the hosts. l.mu must be held
+func (l *limits) sweep() {
+	const minSweep = 64
+	if n := len(l.hosts) + len(l.cooling); n < minSweep || n < 2*l.swept {
+		return
+	}
+	now := time.Now()
+	for host, h := range l.hosts {
+		if h.idle(now) {
+			delete(l.hosts, host)
+		}
+	}
+	for host, until := range l.cooling {
+		if now.After(until) {
+			delete(l.cooling, host)
+		}
+	}
+	l.swept = len(l.hosts) + len(l.cooling)
+}
+
+// observe will start a cool-down of the result's host if the response, or the response to
+// the upgrade, asks the client to slow down. The cool-down lasts for the longer of
+// l.coolDown and the response's Retry-After, which is capped at l.maxAfter
+func (l *limits) observe(r *Result) {
+	if l.coolDown <= 0 {
+		return
+	}
+	var (
+		status int
+		header http.Header
+		uscErr http2.UnexpectedStatusCodeError
+	)
+	switch {
+	case r.Response != nil:
+		status, header = r.Response.StatusCode, r.Response.Header
+	case errors.As(r.Err, &uscErr) && uscErr.Response != nil:
+		status, header = uscErr.Code, uscErr.Response.Header
+	default:
+		return
+	}
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return
+	}
+	host := targetHost(r.Target)
+	d := l.coolDown
+	after := retryAfter(header.Get("Retry-After"))
+	if after > l.maxAfter {
+		log.WithFields(log.Fields{
+			"host":          host,
+			"retry_after":   after.String(),
+			"max_cool_down": l.maxAfter.String(),
+		}).Warnf("retry-after is longer than the maximum cool-down. capping it")
+		after = l.maxAfter
+	}
+	if after > d {
+		d = after
+	}
+
+	until := time.Now().Add(d)
+	l.mu.Lock()
+	if current, ok := l.cooling[host]; !ok || until.After(current) {
+		if !ok {
+			l.sweep()
+		}
+		l.cooling[host] = until
+	}
+	l.mu.Unlock()
+	log.WithFields(log.Fields{
+		"host":      host,
+		"status":    status,
+		"cool_down": d.String(),
+	}).Warnf("host asked us to slow down. pausing requests")
+}
+
+// retryAfter will parse a Retry-After header of either delay seconds or a http date. 0 is
+// returned if it is missing or invalid
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// targetHost will return the host of the target url, which limits are applied to. The
+// target is returned as is if it can't be parsed
+func targetHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Host
+}
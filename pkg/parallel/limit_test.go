@@ -0,0 +1,251 @@
+package parallel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler"
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(20)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first operation starts immediately, then each waits 50ms
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 operations took %v, want at least 200ms", elapsed)
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Errorf("got a limiter for 0 per second, want unlimited")
+	}
+}
+
+func TestLimitsCoolDown(t *testing.T) {
+	c := New()
+	c.CoolDown = 200 * time.Millisecond
+	l := c.limits()
+
+	l.observe(&Result{Target: "http://a.com/ok", Response: &http.Response{StatusCode: 200}})
+	l.observe(&Result{Target: "http://b.com/slow", Response: &http.Response{StatusCode: 429, Header: http.Header{}}})
+
+	start := time.Now()
+	if err := l.wait(context.Background(), "http://a.com/next"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("other host waited %v, want no cool-down", elapsed)
+	}
+	if err := l.wait(context.Background(), "http://b.com/next"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("host waited %v, want the 200ms cool-down", elapsed)
+	}
+}
+
+func TestLimitsMaxCoolDown(t *testing.T) {
+	c := New()
+	c.CoolDown = 50 * time.Millisecond
+	c.MaxCoolDown = 200 * time.Millisecond
+	l := c.limits()
+
+	l.observe(&Result{Target: "http://a.com/slow", Response: &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"3600"}}}})
+
+	start := time.Now()
+	if err := l.wait(context.Background(), "http://a.com/next"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("host waited %v, want the Retry-After capped at 200ms", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if got := retryAfter("2"); got != 2*time.Second {
+		t.Errorf("got %v, want 2s", got)
+	}
+	if got := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); got < 55*time.Second || got > time.Minute {
+		t.Errorf("got %v, want about a minute", got)
+	}
+	for _, v := range []string{"", "soon", "-1"} {
+		if got := retryAfter(v); got != 0 {
+			t.Errorf("retryAfter(%q) = %v, want 0", v, got)
+		}
+	}
+}
+
+func TestClient_LimitsTunnels(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		w.Write([]byte(r.URL.Path))
+	}), &http2.Server{}))
+	defer s.Close()
+
+	c := New()
+	c.MaxConnPerHost = 2
+	c.RequestsPerSecond = 20
+	c.ResultHandler = ResultHandlerFunc(func(r *Result) {})
+	if err := c.GetPathsOnHost(s.URL, []string{s.URL + "/a", s.URL + "/b", s.URL + "/c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the base requests opening each tunnel are spaced out along with the path
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 5 {
+		t.Fatalf("got %d requests, want 2 base requests and 3 paths", len(times))
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < 40*time.Millisecond {
+			t.Errorf("request %d was sent %v after the previous, want 50ms", i, d)
+		}
+	}
+}
+
+func TestClient_LimitsProbes(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times []time.Time
+		conns = map[string]time.Time{}
+	)
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if _, ok := conns[r.RemoteAddr]; !ok {
+			conns[r.RemoteAddr] = time.Now()
+		}
+		if len(times) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(r.URL.Path))
+	}), &http2.Server{}))
+	defer s.Close()
+
+	c := New()
+	c.CoolDown = 200 * time.Millisecond
+	c.UpgradeVariants = h2csmuggler.DefaultUpgradeVariants[:2]
+	c.MatrixHandler = MatrixHandlerFunc(func(r *MatrixResult) {})
+	if err := c.GetUpgradeMatrix([]string{s.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the 503 to the first variant cools down the host before the second
+	mu.Lock()
+	if len(times) != 2 {
+		t.Fatalf("got %d requests, want one for each variant", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < 180*time.Millisecond {
+		t.Errorf("second variant was sent %v after the 503, want 200ms", d)
+	}
+	times, conns = nil, map[string]time.Time{}
+	mu.Unlock()
+
+	c = New()
+	c.RequestsPerSecond = 10
+	c.DesyncTechniques = []h2csmuggler.DesyncTechnique{h2csmuggler.DesyncCL}
+	c.DesyncHandler = DesyncHandlerFunc(func(r *DesyncResult) {})
+	if err := c.ProbeDesync([]string{s.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	// each probe's connection waits for the rate limit
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 2 {
+		t.Fatalf("got %d connections, want one for each probe", len(conns))
+	}
+	var opened []time.Time
+	for _, at := range conns {
+		opened = append(opened, at)
+	}
+	sort.Slice(opened, func(i, j int) bool { return opened[i].Before(opened[j]) })
+	if d := opened[1].Sub(opened[0]); d < 80*time.Millisecond {
+		t.Errorf("second probe was sent %v after the first, want 100ms", d)
+	}
+}
+
+func TestOriginTunnelsRetryLimits(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fail" {
+			return
+		}
+		mu.Lock()
+		times = append(times, time.Now())
+		first := len(times) == 1
+		mu.Unlock()
+		if first {
+			// resets the stream, failing the request on the shared tunnel
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(r.URL.Path))
+	}), &http2.Server{}))
+	defer s.Close()
+
+	c := New()
+	c.RequestsPerSecond = 10
+	o := newOriginTunnels(c, 1)
+	defer o.Close()
+	for _, target := range []string{s.URL + "/ok", s.URL + "/fail"} {
+		if _, err := c.limit(target, func() (*Result, error) { return o.do(target) }); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+	}
+
+	// the retry on a new connection waits for the limits again
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 2 {
+		t.Fatalf("got %d requests of /fail, want the request and its retry", len(times))
+	}
+	if d := times[1].Sub(times[0]); d < 80*time.Millisecond {
+		t.Errorf("retry was sent %v after the failed request, want 100ms", d)
+	}
+}
+
+func TestLimitsSweep(t *testing.T) {
+	c := New()
+	c.HostRequestsPerSecond = 1000
+	c.CoolDown = time.Millisecond
+	l := c.limits()
+
+	for i := 0; i < 300; i++ {
+		target := "http://" + strconv.Itoa(i) + ".example.com/"
+		if err := l.wait(context.Background(), target); err != nil {
+			t.Fatal(err)
+		}
+		l.observe(&Result{Target: target, Response: &http.Response{StatusCode: 429, Header: http.Header{}}})
+		time.Sleep(10 * time.Microsecond)
+	}
+
+	// idle limiters and expired cool-downs should have been removed along the way
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.hosts) + len(l.cooling); n >= 150 {
+		t.Errorf("got %d hosts and cool-downs after 300 hosts, want them to be swept", n)
+	}
+}
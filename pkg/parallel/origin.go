@@ -0,0 +1,217 @@
+package parallel
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assetnote/h2csmuggler"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// originTunnels shares a tunnel between the targets of each origin (scheme, host and port).
+// The first target of an origin establishes the tunnel, and the other targets wait for it
+// then send their requests as additional streams. Idle tunnels are closed once more than max
+// are open, and are re-established if another target of the origin arrives later
+type originTunnels struct {
+	c    *Client
+	opts []h2csmuggler.ConnectionOption
+	max  int
+
+	mu      sync.Mutex
+	tunnels map[string]*originTunnel
+}
+
+// originTunnel is the tunnel of an origin
+type originTunnel struct {
+	origin string
+	ready  chan struct{} // closed once the tunnel has been established or has failed
+
+	// set before ready is closed
+	tun     h2csmuggler.Tunnel // nil if the tunnel could not be established
+	err     error              // why the tunnel could not be established
+	upgrade *h2csmuggler.UpgradeResult
+
+	// guarded by originTunnels.mu
+	inflight int
+	lastUsed time.Time
+	evicted  bool // removed from the map, and closed once no requests are in flight
+}
+
+// newOriginTunnels will return an empty set of tunnels, keeping at most max idle tunnels open.
+// opts are applied to each tunnel along with the client's connection options
+func newOriginTunnels(c *Client, max int, opts ...h2csmuggler.ConnectionOption) *originTunnels {
+	return &originTunnels{
+		c:       c,
+		opts:    opts,
+		max:     max,
+		tunnels: make(map[string]*originTunnel),
+	}
+}
+
+// do will request the target over the tunnel of its origin, establishing the tunnel with the
+// request if there is none. If the tunnel could not be established because the origin is
+// unreachable, the error is reported without dialing again. If it failed for another reason,
+// which may depend on the path, or a request on the tunnel fails, the target is requested on
+// a new connection of its own. do is called within the client's limits, which only cover the
+// first request of the target, so a retry after a failed request waits for them again
+func (o *originTunnels) do(target string) (*Result, error) {
+	origin, err := targetOrigin(target)
+	if err != nil {
+		return o.c.do(target, o.opts...)
+	}
+
+	o.mu.Lock()
+	e, ok := o.tunnels[origin]
+	if !ok {
+		e = &originTunnel{origin: origin, ready: make(chan struct{})}
+		o.tunnels[origin] = e
+	}
+	e.inflight++
+	o.mu.Unlock()
+	defer o.release(e)
+
+	if !ok {
+		return o.establish(e, target)
+	}
+
+	<-e.ready
+	if e.tun == nil {
+		if unreachable(e.err) {
+			return &Result{Target: target, Upgrade: e.upgrade}, errors.Wrap(e.err, "origin unreachable")
+		}
+		// nothing has been sent for this target, so the connection is its first request
+		return o.c.do(target, o.opts...)
+	}
+
+	r, err := doConn(e.tun, target)
+	r.Upgrade = e.upgrade
+	r.Reused = true
+	if err != nil {
+		// the tunnel may have been lost, so the next target re-establishes it
+		log.WithField("target", target).WithError(err).Debugf("request on shared tunnel failed. retrying on a new connection")
+		o.evict(e)
+		l := o.c.limits()
+		l.observe(r)
+		if err := l.wait(context.Background(), target); err != nil {
+			return r, err
+		}
+		return o.c.do(target, o.opts...)
+	}
+	return r, nil
+}
+
+// establish will create the tunnel of the origin with the target's request
+func (o *originTunnels) establish(e *originTunnel, target string) (r *Result, err error) {
+	defer close(e.ready)
+
+	tun, err := h2csmuggler.NewTunnel(o.c.Technique, target, o.c.connectionOptions(o.opts...)...)
+	if err != nil {
+		e.err = err
+		return &Result{Target: target}, errors.Wrap(err, "connect")
+	}
+	r, err = doConn(tun, target)
+	e.upgrade = tun.UpgradeResult()
+	r.Upgrade = e.upgrade
+	if err != nil {
+		tun.Close()
+		e.err = err
+		// keep unreachable origins, so that their other targets fail without dialing
+		if !unreachable(err) {
+			o.evict(e)
+		}
+		return r, err
+	}
+	e.tun = tun
+	return r, nil
+}
+
+// release will mark a request on the tunnel as complete, then close the tunnel if it has been
+// evicted, or the least recently used idle tunnels if more than max are open
+func (o *originTunnels) release(e *originTunnel) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e.inflight--
+	e.lastUsed = time.Now()
+	if e.evicted && e.inflight == 0 && e.tun != nil {
+		e.tun.Close()
+	}
+
+	for len(o.tunnels) > o.max {
+		var oldest *originTunnel
+		for _, t := range o.tunnels {
+			if t.inflight == 0 && (oldest == nil || t.lastUsed.Before(oldest.lastUsed)) {
+				oldest = t
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(o.tunnels, oldest.origin)
+		oldest.evicted = true
+		if oldest.tun != nil {
+			oldest.tun.Close()
+		}
+	}
+}
+
+// evict will remove the tunnel, so that the next target of the origin establishes a new one.
+// The tunnel is closed once its requests complete
+func (o *originTunnels) evict(e *originTunnel) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.tunnels[e.origin] == e {
+		delete(o.tunnels, e.origin)
+	}
+	e.evicted = true
+}
+
+// Close will close every tunnel. This must only be called once no requests are in flight
+func (o *originTunnels) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for origin, e := range o.tunnels {
+		if e.tun != nil {
+			e.tun.Close()
+		}
+		delete(o.tunnels, origin)
+	}
+}
+
+// unreachable will return whether the error shows that the origin can't be connected to at
+// all, rather than failing to upgrade
+func unreachable(err error) bool {
+	switch h2csmuggler.ErrorKind(err) {
+	case h2csmuggler.KindDNS, h2csmuggler.KindRefused, h2csmuggler.KindConnect, h2csmuggler.KindTLS:
+		return true
+	}
+	return false
+}
+
+// targetOrigin will return the scheme://host:port of the target, inferring the port from
+// the scheme
+func targetOrigin(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	switch scheme {
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return "", h2csmuggler.ErrUnexpectedScheme
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
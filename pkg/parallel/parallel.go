@@ -1,61 +1,372 @@
 package parallel
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/assetnote/h2csmuggler"
-	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/hpack"
 	"github.com/pkg/errors"
 )
 
 const (
-	DefaultConnPerHost   = 5
-	DefaultParallelHosts = 10
+	DefaultConnPerHost    = 5
+	DefaultParallelHosts  = 10
+	DefaultStreamsPerConn = 10
+
+	// DefaultMaxCoolDown is the longest cool-down a Retry-After may ask for, when
+	// Client.MaxCoolDown is unset
+	DefaultMaxCoolDown = 5 * time.Minute
+)
+
+// The modes used to establish a h2c connection. These are reported on each result
+const (
+	ModeUpgrade        = "upgrade"
+	ModePriorKnowledge = "prior-knowledge"
+	ModeWebSocket      = "websocket"
 )
 
 type Client struct {
 	MaxConnPerHost   int
 	MaxParallelHosts int
+
+	// MaxStreamsPerConn is the number of concurrent requests sent over each h2c connection
+	// when requesting paths on a host. The server's SETTINGS_MAX_CONCURRENT_STREAMS is
+	// still respected, so this may be lower in practice
+	MaxStreamsPerConn int
+
+	// ConnectionOptions are applied to every h2c connection created by the client
+	ConnectionOptions []h2csmuggler.ConnectionOption
+
+	// PriorKnowledge will additionally check each target in GetParallelHosts with prior
+	// knowledge h2c. The results are reported separately from the upgrade results
+	PriorKnowledge bool
+
+	// UpgradeVariants are tried against each target by GetUpgradeMatrix. If nil,
+	// h2csmuggler.DefaultUpgradeVariants is used
+	UpgradeVariants []h2csmuggler.UpgradeVariant
+
+	// CapturePush will enable server push on the connections used to smuggle requests, logging
+	// each pushed request and response alongside the results
+	CapturePush bool
+
+	// DesyncTechniques are tried against each target by ProbeDesync. If nil,
+	// h2csmuggler.DesyncTechniques is used
+	DesyncTechniques []h2csmuggler.DesyncTechnique
+
+	// DesyncOptions configure the probes sent by ProbeDesync
+	DesyncOptions []h2csmuggler.DesyncOption
+
+	// Technique is how tunnels are established by GetParallelHosts, GetPathsOnHost and
+	// GetPathDiffOnHost. One of h2csmuggler.Techniques, defaulting to h2c
+	Technique string
+
+	// ResultHandler receives the result of each request made by GetParallelHosts and
+	// GetPathsOnHost. Results are passed to the handler one at a time, as they complete.
+	// If nil, GetParallelHosts uses LogHostResults and GetPathsOnHost uses LogResults
+	ResultHandler ResultHandler
+
+	// DiffHandler receives the comparison of each target requested by GetPathDiffOnHost,
+	// one at a time. If nil, the targets which differ are logged with LogDiffs
+	DiffHandler DiffHandler
+
+	// MatrixHandler receives the results of each target of GetUpgradeMatrix, one at a time.
+	// If nil, they are logged with LogMatrix
+	MatrixHandler MatrixHandler
+
+	// DesyncHandler receives the results of each target of ProbeDesync, one at a time. If
+	// nil, they are logged with LogDesync
+	DesyncHandler DesyncHandler
+
+	// RequestsPerSecond limits the requests sent by the client across all hosts. Requests are
+	// evenly spaced rather than sent in bursts. 0 is unlimited. The base requests which
+	// establish and re-establish tunnels count as requests, as does each connection opened by
+	// GetUpgradeMatrix and ProbeDesync
+	RequestsPerSecond float64
+
+	// HostRequestsPerSecond limits the requests sent to each host, as given by the host of
+	// the target url. 0 is unlimited
+	HostRequestsPerSecond float64
+
+	// Jitter delays each request by a random duration of up to Jitter, after the rate limits
+	Jitter time.Duration
+
+	// UpgradesPerSecond limits the new tunnels established across all hosts, including
+	// retries and re-upgrades of lost tunnels. 0 is unlimited
+	UpgradesPerSecond float64
+
+	// CoolDown pauses requests to a host after it responds with a 429 or 503, for CoolDown or
+	// the response's Retry-After if longer, up to MaxCoolDown. 0 disables the cool-down
+	CoolDown time.Duration
+
+	// MaxCoolDown caps the cool-down asked for by a Retry-After, so that a host can't pause
+	// the client indefinitely. CoolDown itself is never capped. If 0, DefaultMaxCoolDown is
+	// used
+	MaxCoolDown time.Duration
+
+	// DisableBatching will make GetParallelHosts establish a new tunnel for every target,
+	// rather than sharing a tunnel between the targets of each origin
+	DisableBatching bool
+
+	// Checkpoint, if non-nil, records each completed target. Targets completed by a previous
+	// run are skipped. See OpenCheckpoint
+	Checkpoint *Checkpoint
+
+	// The limits are created from the fields above on first use, and shared by every
+	// method of the client
+	limitsOnce sync.Once
+	rateLimits *limits
 }
 
 func New() *Client {
 	return &Client{}
 }
 
-// do will create a connection and perform the request. this is a convenience function
+// do will create a tunnel and perform the request. this is a convenience function
 // to let us defer closing the connection and body without leaking it until the worker loop
 // ends
-func do(target string) (r res, err error) {
-	r.target = target
-	conn, err := h2csmuggler.NewConn(target, h2csmuggler.ConnectionMaxRetries(3))
+func (c *Client) do(target string, opts ...h2csmuggler.ConnectionOption) (r *Result, err error) {
+	conn, err := h2csmuggler.NewTunnel(c.Technique, target, c.connectionOptions(opts...)...)
 	if err != nil {
-		return r, errors.Wrap(err, "connect")
+		return &Result{Target: target}, errors.Wrap(err, "connect")
 	}
 	defer conn.Close()
 
-	return doConn(conn, target)
+	r, err = doConn(conn, target)
+	r.Upgrade = conn.UpgradeResult()
+	return r, err
+}
+
+// newConn will create a h2c connection to the target with the client's connection options
+func (c *Client) newConn(target string, opts ...h2csmuggler.ConnectionOption) (*h2csmuggler.Conn, error) {
+	return h2csmuggler.NewConn(target, c.connectionOptions(opts...)...)
+}
+
+// connectionOptions will return the options for each h2c connection created by the client
+func (c *Client) connectionOptions(opts ...h2csmuggler.ConnectionOption) []h2csmuggler.ConnectionOption {
+	ret := append([]h2csmuggler.ConnectionOption{h2csmuggler.ConnectionMaxRetries(3)}, c.ConnectionOptions...)
+	if l := c.limits().upgrades; l != nil {
+		ret = append(ret, h2csmuggler.ConnectionLimiter(l))
+	}
+	return append(ret, opts...)
+}
+
+// tunnelOptions will return the options for tunnels to base which are established outside of
+// c.limit, such as the tunnels opened with the base request and re-upgraded when lost. Each
+// dial waits for the client's limits of base as well as the upgrade limit, as it sends the
+// base request
+func (c *Client) tunnelOptions(base string, opts ...h2csmuggler.ConnectionOption) []h2csmuggler.ConnectionOption {
+	l := c.limits()
+	limiter := limiterFunc(func(ctx context.Context) error {
+		if err := l.wait(ctx, base); err != nil {
+			return err
+		}
+		if l.upgrades != nil {
+			return l.upgrades.Wait(ctx)
+		}
+		return nil
+	})
+	// replaces the upgrade limiter of c.connectionOptions
+	return append(c.connectionOptions(opts...), h2csmuggler.ConnectionLimiter(limiter))
+}
+
+// probeOptions will return the options for the connections opened by GetUpgradeMatrix and
+// ProbeDesync to target. Like tunnelOptions, each dial waits for the client's limits, and
+// each response sent over the connection is observed for a cool-down
+func (c *Client) probeOptions(target string) []h2csmuggler.ConnectionOption {
+	l := c.limits()
+	observer := func(res *http.Response, err error) {
+		l.observe(&Result{Target: target, Response: res, Err: err})
+	}
+	return append(c.tunnelOptions(target), h2csmuggler.ConnectionResponseObserver(observer))
+}
+
+// tunnels are shared by the workers sending requests to a host
+type tunnels interface {
+	Doer
+	Close()
+}
+
+// tunnelPool sends requests through a pool of h2c connections to base. Connections which are
+// lost are transparently re-upgraded with the base request
+type tunnelPool struct {
+	pool   *h2csmuggler.Pool
+	base   string
+	muts   []RequestMutation
+	raw    []hpack.HeaderField // if non-nil, requests are sent in raw headers mode
+	pseudo []hpack.HeaderField // pseudo-header overrides
+}
+
+// openTunnels will create n tunnels to base with c.Technique, and initialize each with the
+// base request. The tunnels are established concurrently, and this returns once they all
+// have completed
+func (c *Client) openTunnels(base string, n int, o *ParallelOptions) tunnels {
+	if c.Technique == h2csmuggler.TechniqueWebSocket {
+		return c.openWebSocketTunnels(base, n, o)
+	}
+
+	var opts []h2csmuggler.ConnectionOption
+	if c.CapturePush {
+		opts = append(opts, h2csmuggler.ConnectionPushHandler(logPush(o.PrettyPrint)))
+	}
+	t := &tunnelPool{
+		pool: h2csmuggler.NewPool(
+			h2csmuggler.PoolMaxConns(n),
+			h2csmuggler.PoolConnectionOptions(c.tunnelOptions(base, opts...)...),
+		),
+		base:   base,
+		muts:   o.RequestMutations,
+		raw:    o.RawHeaders,
+		pseudo: o.PseudoHeaders,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// initialize the connection with our first base request
+			req, err := newRequest(base, o.RequestMutations...)
+			if err == nil {
+				_, err = t.pool.Get(req.Context(), req)
+				// the response is discarded by the pool, however a refused upgrade may still
+				// ask us to slow down
+				c.limits().observe(&Result{Target: base, Err: err})
+			}
+			if err != nil {
+				log.WithField("target", base).WithError(err).Tracef("failed to request")
+			}
+			// don't return the result because its expected for this to work
+		}()
+	}
+	wg.Wait()
+	return t
+}
+
+// Do will send the request over the next tunnel in the pool
+func (t *tunnelPool) Do(req *http.Request) (*http.Response, error) {
+	upgrade, err := newRequest(t.base, t.muts...)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.pool.Get(req.Context(), upgrade)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect")
+	}
+	if t.pseudo != nil {
+		req = h2csmuggler.WithPseudoHeaders(req, t.pseudo...)
+	}
+	if t.raw != nil {
+		req = h2csmuggler.WithRawHeaders(req, append(h2csmuggler.HeaderFields(req), t.raw...)...)
+	}
+	return conn.Do(req)
+}
+
+func (t *tunnelPool) Close() {
+	t.pool.Close()
+}
+
+// streamWorkers will return the number of workers to use for the targets, when sharing
+// maxConns connections. targets is negative if the number of targets is unknown
+func (c *Client) streamWorkers(maxConns int, targets int) int {
+	streams := c.MaxStreamsPerConn
+	if streams == 0 {
+		streams = DefaultStreamsPerConn
+	}
+	workers := maxConns * streams
+	if targets >= 0 && targets < workers {
+		workers = targets
+	}
+	return workers
+}
+
+// maxConnsPerHost will return the number of connections to open to a host for the targets.
+// targets is negative if the number of targets is unknown
+func (c *Client) maxConnsPerHost(targets int) int {
+	maxConns := c.MaxConnPerHost
+	if maxConns == 0 {
+		maxConns = DefaultConnPerHost
+	}
+
+	// don't need to spin up 10 threads for just 2 targets
+	if targets >= 0 && targets < maxConns {
+		maxConns = targets
+	}
+	return maxConns
+}
+
+// dispatch will send each target to every channel in ins, skipping the targets completed with
+// every one of modes by a previous run, then close the channels
+func (c *Client) dispatch(targets <-chan string, modes []string, ins ...chan<- string) {
+	skipped := 0
+	for t := range targets {
+		if c.done(t, modes...) {
+			log.WithField("target", t).Tracef("skipping completed target")
+			skipped++
+			continue
+		}
+		log.WithField("target", t).Tracef("scheduling")
+		for _, in := range ins {
+			in <- t
+		}
+	}
+	for _, in := range ins {
+		close(in)
+	}
+	if skipped > 0 {
+		log.WithField("skipped", skipped).Infof("skipped targets completed by a previous run")
+	}
+}
+
+// done will return whether the target was completed with every one of modes by a previous run
+func (c *Client) done(target string, modes ...string) bool {
+	for _, mode := range modes {
+		if !c.Checkpoint.Done(target, mode) {
+			return false
+		}
+	}
+	return true
+}
+
+// Targets will return a channel which yields each of targets in order, then is closed. This
+// adapts a slice for the Stream variants of the client's methods
+func Targets(targets []string) <-chan string {
+	ch := make(chan string)
+	go func() {
+		for _, t := range targets {
+			ch <- t
+		}
+		close(ch)
+	}()
+	return ch
 }
 
 type Doer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-func doConn(conn Doer, target string, muts ...RequestMutation) (r res, err error) {
-	r.target = target
-	req, err := http.NewRequest("GET", target, nil)
+// doConn will request the target over conn. The result is always returned, recording the
+// request and how long it took even if it failed
+func doConn(conn Doer, target string, muts ...RequestMutation) (r *Result, err error) {
+	r = &Result{Target: target}
+	req, err := newRequest(target, muts...)
 	if err != nil {
 		return r, errors.Wrap(err, "request creation")
 	}
-	for _, mut := range muts {
-		mut(req)
-	}
+	r.Request = req
 
+	start := time.Now()
+	defer func() {
+		r.Duration = time.Since(start)
+	}()
 	res, err := conn.Do(req)
 	if err != nil {
 		return r, errors.Wrap(err, "connection do")
@@ -67,16 +378,36 @@ func doConn(conn Doer, target string, muts ...RequestMutation) (r res, err error
 		return r, errors.Wrap(err, "body read")
 	}
 
-	r.body = body
-	r.res = res
+	r.Body = body
+	r.Response = res
 	return r, nil
 }
 
+// newRequest will create a GET request to the target with the mutations applied
+func newRequest(target string, muts ...RequestMutation) (*http.Request, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mut := range muts {
+		mut(req)
+	}
+	return req, nil
+}
+
 type ParallelOption func(o *ParallelOptions)
 type RequestMutation func(req *http.Request)
 type ParallelOptions struct {
 	RequestMutations []RequestMutation
 	PrettyPrint      bool
+
+	// RawHeaders are appended verbatim to the header block of each smuggled request. See
+	// RequestRawHeader
+	RawHeaders []hpack.HeaderField
+
+	// PseudoHeaders override the pseudo-headers of each smuggled request. See
+	// RequestPseudoHeader
+	PseudoHeaders []hpack.HeaderField
 }
 
 func PrettyPrint(v bool) ParallelOption {
@@ -98,6 +429,25 @@ func RequestHeader(key string, value string) ParallelOption {
 	}
 }
 
+// RequestRawHeader will send each smuggled request in raw headers mode, with the header
+// appended verbatim to its header block. In raw headers mode, the request's pseudo-headers and
+// headers are sent without being validated or normalized. This only applies to requests sent
+// over the h2c connection
+func RequestRawHeader(name string, value string) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.RawHeaders = append(o.RawHeaders, hpack.HeaderField{Name: name, Value: value})
+	}
+}
+
+// RequestPseudoHeader will override the pseudo-header of each smuggled request, or add it if
+// it is not one of :authority, :method, :path or :scheme. The value is not validated. This only
+// applies to requests sent over the h2c connection
+func RequestPseudoHeader(name string, value string) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.PseudoHeaders = append(o.PseudoHeaders, hpack.HeaderField{Name: name, Value: value})
+	}
+}
+
 func RequestMethod(method string) ParallelOption {
 	return func(o *ParallelOptions) {
 		mut := func(r *http.Request) {
@@ -107,22 +457,71 @@ func RequestMethod(method string) ParallelOption {
 	}
 }
 
+// RequestBody will send body with each request, including the upgrade request. The body is
+// framed with a Content-Length unless RequestChunked is used
+func RequestBody(body []byte) ParallelOption {
+	return func(o *ParallelOptions) {
+		mut := func(r *http.Request) {
+			r.ContentLength = int64(len(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+			r.Body, _ = r.GetBody()
+		}
+		o.RequestMutations = append(o.RequestMutations, mut)
+	}
+}
+
+// RequestChunked will send the request body with chunked Transfer-Encoding on HTTP/1.1,
+// including the upgrade request
+func RequestChunked(v bool) ParallelOption {
+	return func(o *ParallelOptions) {
+		if !v {
+			return
+		}
+		mut := func(r *http.Request) {
+			r.TransferEncoding = []string{"chunked"}
+		}
+		o.RequestMutations = append(o.RequestMutations, mut)
+	}
+}
+
+// RequestExpectContinue will add Expect: 100-continue to each request, holding back the
+// body of the upgrade request until the server responds with 100 Continue
+func RequestExpectContinue(v bool) ParallelOption {
+	return func(o *ParallelOptions) {
+		if !v {
+			return
+		}
+		mut := func(r *http.Request) {
+			r.Header.Set("Expect", "100-continue")
+		}
+		o.RequestMutations = append(o.RequestMutations, mut)
+	}
+}
+
 // GetPathDiffOnHost will send the targets to the base host on both a http2 and a h2c connection
 // the results will be diffed
-// this will use c.MaxConnPerHost to parallelize the paths
+// this will use c.MaxConnPerHost connections, each with c.MaxStreamsPerConn concurrent streams,
+// to parallelize the paths
 // This assumes that the host can be connected to over h2c. This will fail if attempted
 // with a host that cannot be h2c smuggled
 // TODO: minimize allocations here, since we explode out a lot
 func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...ParallelOption) error {
-	maxConns := c.MaxConnPerHost
-	if maxConns == 0 {
-		maxConns = DefaultConnPerHost
-	}
+	return c.getPathDiffOnHost(base, Targets(targets), len(targets), opts...)
+}
 
-	// don't need to spin up 10 threads for just 2 targets
-	if len(targets) < maxConns {
-		maxConns = len(targets)
-	}
+// GetPathDiffOnHostStream is like GetPathDiffOnHost, however the targets are received from the
+// channel until it is closed. Requests start with the first target, and targets are only
+// held while they are in flight. c.MaxConnPerHost connections are always opened
+func (c *Client) GetPathDiffOnHostStream(base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.getPathDiffOnHost(base, targets, -1, opts...)
+}
+
+// getPathDiffOnHost implements GetPathDiffOnHost. count is the number of targets, or negative
+// if unknown
+func (c *Client) getPathDiffOnHost(base string, targets <-chan string, count int, opts ...ParallelOption) error {
+	maxConns := c.maxConnsPerHost(count)
 
 	o := &ParallelOptions{}
 	for _, opt := range opts {
@@ -135,10 +534,17 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 		return errors.Wrap(err, "failed to parse base")
 	}
 
+	// dial the normal requests the same way as our h2c connections, e.g. through the same proxy
+	dialer, err := c.newConn(base)
+	if err != nil {
+		return errors.Wrap(err, "failed to create dialer")
+	}
+	// use the same tls settings, however leave the protocol negotiation to the transport
+	tlsConfig := dialer.TLSConfig()
+	tlsConfig.NextProtos = nil
 	http2Client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: tlsConfig,
 	}}
 
 	// create a mutation for our HTTP2 client so it connects on the right
@@ -151,19 +557,22 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 	var wg sync.WaitGroup
 	inh2c := make(chan string, maxConns)
 	inhttp2 := make(chan string, maxConns)
-	outh2c := make(chan res, maxConns)
-	outhttp2 := make(chan res, maxConns)
+	outh2c := make(chan *Result, maxConns)
+	outhttp2 := make(chan *Result, maxConns)
+	workers := c.streamWorkers(maxConns, count)
 
 	// Create our http2 worker threads
-	for i := 0; i < maxConns; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			for t := range inhttp2 {
 				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(http2Client, t, http2ClientMutations...)
+				r, err := c.limit(t, func() (*Result, error) {
+					return doConn(http2Client, t, http2ClientMutations...)
+				})
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
-					r.err = err
+					r.Err = err
 				}
 				outhttp2 <- r
 			}
@@ -172,38 +581,20 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 		}()
 	}
 
-	// Create our h2c worker threads
-	for i := 0; i < maxConns; i++ {
+	// Create our h2c worker threads, sharing the tunnels between the workers
+	tunnels := c.openTunnels(base, maxConns, o)
+	defer tunnels.Close()
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			conn, connErr := h2csmuggler.NewConn(base, h2csmuggler.ConnectionMaxRetries(3))
-			if connErr == nil {
-				defer conn.Close()
-			}
-
-			// initialize the connection with our first base request
-			r, err := doConn(conn, base, o.RequestMutations...)
-			if err != nil {
-				log.WithField("target", base).WithError(err).Tracef("failed to request")
-				r.err = err
-			}
-			// don't return the result because its expected for this to work
-
 			for t := range inh2c {
-				// just discard all results if we can't connect.
-				if connErr != nil {
-					outh2c <- res{
-						target: t,
-						err:    connErr,
-					}
-					continue
-				}
-
 				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(conn, t, o.RequestMutations...)
+				r, err := c.limit(t, func() (*Result, error) {
+					return doConn(tunnels, t, o.RequestMutations...)
+				})
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
-					r.err = err
+					r.Err = err
 				}
 				log.Tracef("got result: %+v", r)
 				outh2c <- r
@@ -217,13 +608,7 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 	swg.Add(1)
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
-			log.WithField("target", t).Tracef("scheduling")
-			inhttp2 <- t
-			inh2c <- t
-		}
-		close(inh2c)
-		close(inhttp2)
+		c.dispatch(targets, []string{""}, inhttp2, inh2c)
 
 		// wait for all the workers to finish, then close our respones channel
 		wg.Wait()
@@ -235,33 +620,30 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 	// Fan-in results
 	results := NewDiffer(true)
 	results.PrettyPrint = o.PrettyPrint
-	h2cClosed := false
-	http2Closed := false
-	for {
-		if h2cClosed && http2Closed {
-			break
-		}
+	h := c.DiffHandler
+	if h == nil {
+		h = LogDiffs(o.PrettyPrint)
+	}
+	results.Handler = DiffHandlerFunc(func(d *DiffResult) {
+		h.HandleDiff(d)
+		c.Checkpoint.RecordDiff(d)
+	})
+	// each channel is set to nil once closed, to stop selecting it
+	h2cResults, http2Results := outh2c, outhttp2
+	for h2cResults != nil || http2Results != nil {
 		select {
-		case r := <-outh2c:
-			{
-				if r.IsNil() {
-					h2cClosed = true
-					break
-				}
-				tmp := r
-				// r.Log("h2c")
-				results.ShowDiffH2C(&tmp)
+		case r, ok := <-h2cResults:
+			if !ok {
+				h2cResults = nil
+				break
 			}
-		case r := <-outhttp2:
-			{
-				if r.IsNil() {
-					http2Closed = true
-					break
-				}
-				tmp := r
-				// r.Log("http2")
-				results.ShowDiffHTTP2(&tmp)
+			results.ShowDiffH2C(r)
+		case r, ok := <-http2Results:
+			if !ok {
+				http2Results = nil
+				break
 			}
+			results.ShowDiffHTTP2(r)
 		}
 	}
 
@@ -272,20 +654,26 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 }
 
 // GetPathsOnHost will send the targets to the base host
-// this will use c.MaxConnPerHost to parallelize the paths
+// this will use c.MaxConnPerHost connections, each with c.MaxStreamsPerConn concurrent streams,
+// to parallelize the paths
 // This assumes that the host can be connected to over h2c. This will fail if attempted
 // with a host that cannot be h2c smuggled
 // TODO: minimize allocations here, since we explode out a lot
 func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelOption) error {
-	maxConns := c.MaxConnPerHost
-	if maxConns == 0 {
-		maxConns = DefaultConnPerHost
-	}
+	return c.getPathsOnHost(base, Targets(targets), len(targets), opts...)
+}
 
-	// don't need to spin up 10 threads for just 2 targets
-	if len(targets) < maxConns {
-		maxConns = len(targets)
-	}
+// GetPathsOnHostStream is like GetPathsOnHost, however the targets are received from the
+// channel until it is closed. Requests start with the first target, and targets are only
+// held while they are in flight. c.MaxConnPerHost connections are always opened
+func (c *Client) GetPathsOnHostStream(base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.getPathsOnHost(base, targets, -1, opts...)
+}
+
+// getPathsOnHost implements GetPathsOnHost. count is the number of targets, or negative if
+// unknown
+func (c *Client) getPathsOnHost(base string, targets <-chan string, count int, opts ...ParallelOption) error {
+	maxConns := c.maxConnsPerHost(count)
 
 	o := &ParallelOptions{}
 	for _, opt := range opts {
@@ -300,40 +688,22 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 
 	var wg sync.WaitGroup
 	in := make(chan string, maxConns)
-	out := make(chan res, maxConns)
+	out := make(chan *Result, maxConns)
 
-	// Create our worker threads
-	for i := 0; i < maxConns; i++ {
+	// Create our worker threads, sharing the tunnels between the workers
+	tunnels := c.openTunnels(base, maxConns, o)
+	defer tunnels.Close()
+	for i := 0; i < c.streamWorkers(maxConns, count); i++ {
 		wg.Add(1)
 		go func() {
-			conn, connErr := h2csmuggler.NewConn(base, h2csmuggler.ConnectionMaxRetries(3))
-			if connErr == nil {
-				defer conn.Close()
-			}
-
-			// initialize the connection with our first base request
-			r, err := doConn(conn, base, o.RequestMutations...)
-			if err != nil {
-				log.WithField("target", base).WithError(err).Tracef("failed to request")
-				r.err = err
-			}
-			// don't return the result because its expected for this to work
-
 			for t := range in {
-				// just discard all results if we can't connect.
-				if connErr != nil {
-					out <- res{
-						target: t,
-						err:    connErr,
-					}
-					continue
-				}
-
 				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(conn, t, o.RequestMutations...)
+				r, err := c.limit(t, func() (*Result, error) {
+					return doConn(tunnels, t, o.RequestMutations...)
+				})
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
-					r.err = err
+					r.Err = err
 				}
 				out <- r
 			}
@@ -346,11 +716,7 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 	swg.Add(1)
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
-			log.WithField("target", t).Tracef("scheduling")
-			in <- t
-		}
-		close(in)
+		c.dispatch(targets, []string{""}, in)
 
 		// wait for all the workers to finish, then close our respones channel
 		wg.Wait()
@@ -359,8 +725,13 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 	}()
 
 	// Fan-in results
+	h := c.ResultHandler
+	if h == nil {
+		h = LogResults(o.PrettyPrint)
+	}
 	for r := range out {
-		r.Log("h2c", o.PrettyPrint)
+		h.HandleResult(r)
+		c.Checkpoint.Record(r)
 	}
 
 	// Wait for workers to cleanup
@@ -369,9 +740,19 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 	return nil
 }
 
-// GetParallelHosts will retrieve each target on a separate connection
+// GetParallelHosts will retrieve each target over a tunnel to its origin (scheme, host and
+// port). The first target of an origin establishes the tunnel, and the other targets are sent
+// as additional streams once it works. If the tunnel can't be established, or a request on
+// it fails, the target is retried on a tunnel of its own. Results are reported per target.
+// With c.DisableBatching, every target is sent on a new tunnel
 // This uses a simple fan-out fan-in concurrency model
 func (c *Client) GetParallelHosts(targets []string) error {
+	return c.GetParallelHostsStream(Targets(targets))
+}
+
+// GetParallelHostsStream is like GetParallelHosts, however the targets are received from the
+// channel until it is closed. Requests start with the first target
+func (c *Client) GetParallelHostsStream(targets <-chan string) error {
 	maxHosts := c.MaxParallelHosts
 	if maxHosts == 0 {
 		maxHosts = DefaultParallelHosts
@@ -379,19 +760,70 @@ func (c *Client) GetParallelHosts(targets []string) error {
 
 	var wg sync.WaitGroup
 	in := make(chan string, maxHosts)
-	out := make(chan res, maxHosts)
+	out := make(chan *Result, maxHosts)
+
+	// each target is checked with the technique, and with prior knowledge if enabled
+	mode := ModeUpgrade
+	if c.Technique == h2csmuggler.TechniqueWebSocket {
+		mode = ModeWebSocket
+	}
+	modes := []string{mode}
+	priorKnowledge := c.PriorKnowledge && mode != ModeWebSocket
+	if priorKnowledge {
+		modes = append(modes, ModePriorKnowledge)
+	}
+
+	// do will request the target with the mode. Unless batching is disabled, a tunnel is
+	// shared between the targets of each origin and mode, keeping one idle tunnel per worker
+	do := func(t string, mode string) (*Result, error) {
+		if mode == ModePriorKnowledge {
+			return c.do(t, h2csmuggler.ConnectionPriorKnowledge(true))
+		}
+		return c.do(t)
+	}
+	if !c.DisableBatching {
+		upgradeTunnels := newOriginTunnels(c, maxHosts)
+		defer upgradeTunnels.Close()
+		priorKnowledgeTunnels := newOriginTunnels(c, maxHosts, h2csmuggler.ConnectionPriorKnowledge(true))
+		defer priorKnowledgeTunnels.Close()
+		do = func(t string, mode string) (*Result, error) {
+			if mode == ModePriorKnowledge {
+				return priorKnowledgeTunnels.do(t)
+			}
+			return upgradeTunnels.do(t)
+		}
+	}
 
 	// Create our worker threads
 	for i := 0; i < maxHosts; i++ {
 		wg.Add(1)
 		go func() {
 			for t := range in {
-				log.WithField("target", t).Tracef("requesting")
-				r, err := do(t)
+				// a previous run may have only completed one of the modes
+				if !c.Checkpoint.Done(t, mode) {
+					log.WithField("target", t).Tracef("requesting")
+					r, err := c.limit(t, func() (*Result, error) {
+						return do(t, mode)
+					})
+					if err != nil {
+						log.WithField("target", t).WithError(err).Tracef("failed to request")
+						r.Err = err
+					}
+					r.Mode = mode
+					out <- r
+				}
+
+				if !priorKnowledge || c.Checkpoint.Done(t, ModePriorKnowledge) {
+					continue
+				}
+				r, err := c.limit(t, func() (*Result, error) {
+					return do(t, ModePriorKnowledge)
+				})
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
-					r.err = err
+					r.Err = err
 				}
+				r.Mode = ModePriorKnowledge
 				out <- r
 			}
 
@@ -403,11 +835,7 @@ func (c *Client) GetParallelHosts(targets []string) error {
 	swg.Add(1)
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
-			log.WithField("target", t).Tracef("scheduling")
-			in <- t
-		}
-		close(in)
+		c.dispatch(targets, modes, in)
 
 		// wait for all the workers to finish, then close our respones channel
 		wg.Wait()
@@ -415,37 +843,170 @@ func (c *Client) GetParallelHosts(targets []string) error {
 		swg.Done()
 	}()
 
-	// Fan-in results
+	// Fan-in results, counting the reason for each failure
+	var (
+		results  int
+		failures = map[h2csmuggler.UpgradeErrorKind]int{}
+	)
+	h := c.ResultHandler
+	if h == nil {
+		h = LogHostResults()
+	}
 	for r := range out {
 		log.WithField("res", r).Tracef("recieved")
-		if r.err != nil {
-			var uscErr http2.UnexpectedStatusCodeError
-			if errors.As(r.err, &uscErr) {
-				log.WithFields(log.Fields{
-					"status": uscErr.Code,
-					"target": r.target,
-				}).Errorf("unexpected status code")
-			} else {
-				log.WithField("target", r.target).WithError(r.err).Debugf("failed")
+		results++
+		if r.Err != nil {
+			failures[failureReason(r.Err)]++
+		}
+		h.HandleResult(r)
+		c.Checkpoint.Record(r)
+	}
+
+	failed := 0
+	for _, n := range failures {
+		failed += n
+	}
+	log.WithFields(log.Fields{
+		"results":   results,
+		"succeeded": results - failed,
+		"failures":  failures,
+	}).Infof("summary")
+
+	// Wait for workers to cleanup
+	wg.Wait()
+	swg.Wait()
+	return nil
+}
+
+// failureReason will classify the error from requesting a target. Errors before the upgrade,
+// such as creating the request, are reported as other
+func failureReason(err error) h2csmuggler.UpgradeErrorKind {
+	if kind := h2csmuggler.ErrorKind(err); kind != "" {
+		return kind
+	}
+	return h2csmuggler.KindOther
+}
+
+// GetUpgradeMatrix will attempt to upgrade each target with every variant in
+// c.UpgradeVariants, or h2csmuggler.DefaultUpgradeVariants if unset. The results of each
+// target are passed to c.MatrixHandler, reporting whether each variant produced a 101 and a
+// working stream 1.
+// this will use c.MaxParallelHosts to parallelize the targets
+func (c *Client) GetUpgradeMatrix(targets []string) error {
+	return c.GetUpgradeMatrixStream(Targets(targets))
+}
+
+// GetUpgradeMatrixStream is like GetUpgradeMatrix, however the targets are received from the
+// channel until it is closed
+func (c *Client) GetUpgradeMatrixStream(targets <-chan string) error {
+	maxHosts := c.MaxParallelHosts
+	if maxHosts == 0 {
+		maxHosts = DefaultParallelHosts
+	}
+
+	var wg sync.WaitGroup
+	in := make(chan string, maxHosts)
+	out := make(chan *MatrixResult, maxHosts)
+
+	// Create our worker threads
+	for i := 0; i < maxHosts; i++ {
+		wg.Add(1)
+		go func() {
+			for t := range in {
+				log.WithField("target", t).Tracef("detecting")
+				results, err := h2csmuggler.DetectUpgrade(context.Background(), t, c.UpgradeVariants, c.probeOptions(t)...)
+				out <- &MatrixResult{Target: t, Results: results, Err: err}
 			}
-		} else {
-			switch log.GetLevel() {
-			case log.DebugLevel:
-				log.WithFields(log.Fields{
-					"status":  r.res.StatusCode,
-					"body":    r.body,
-					"target":  r.target,
-					"headers": r.res.Header,
-				}).Infof("success")
-			default:
-				log.WithFields(log.Fields{
-					"status":  r.res.StatusCode,
-					"body":    len(r.body),
-					"target":  r.target,
-					"headers": r.res.Header,
-				}).Infof("success")
+
+			wg.Done()
+		}()
+	}
+
+	var swg sync.WaitGroup
+	swg.Add(1)
+	// Create our dispatcher thread
+	go func() {
+		c.dispatch(targets, []string{modeMatrix}, in)
+
+		// wait for all the workers to finish, then close our respones channel
+		wg.Wait()
+		close(out)
+		swg.Done()
+	}()
+
+	h := c.MatrixHandler
+	if h == nil {
+		h = LogMatrix()
+	}
+
+	// Fan-in results
+	for r := range out {
+		h.HandleMatrix(r)
+		c.Checkpoint.recordTarget(r.Target, modeMatrix, r.Err)
+	}
+
+	// Wait for workers to cleanup
+	wg.Wait()
+	swg.Wait()
+	return nil
+}
+
+// ProbeDesync will check whether the hop behind the h2c tunnel to each target can be
+// desynchronised with each of c.DesyncTechniques. The results of each target are passed to
+// c.DesyncHandler.
+// this will use c.MaxParallelHosts to parallelize the targets
+func (c *Client) ProbeDesync(targets []string) error {
+	return c.ProbeDesyncStream(Targets(targets))
+}
+
+// ProbeDesyncStream is like ProbeDesync, however the targets are received from the channel
+// until it is closed
+func (c *Client) ProbeDesyncStream(targets <-chan string) error {
+	maxHosts := c.MaxParallelHosts
+	if maxHosts == 0 {
+		maxHosts = DefaultParallelHosts
+	}
+
+	var wg sync.WaitGroup
+	in := make(chan string, maxHosts)
+	out := make(chan *DesyncResult, maxHosts)
+
+	// Create our worker threads
+	for i := 0; i < maxHosts; i++ {
+		wg.Add(1)
+		go func() {
+			for t := range in {
+				log.WithField("target", t).Tracef("probing")
+				opts := append([]h2csmuggler.DesyncOption{h2csmuggler.DesyncConnectionOptions(c.probeOptions(t)...)}, c.DesyncOptions...)
+				results, err := h2csmuggler.ProbeDesync(context.Background(), t, c.DesyncTechniques, opts...)
+				out <- &DesyncResult{Target: t, Results: results, Err: err}
 			}
-		}
+
+			wg.Done()
+		}()
+	}
+
+	var swg sync.WaitGroup
+	swg.Add(1)
+	// Create our dispatcher thread
+	go func() {
+		c.dispatch(targets, []string{modeDesync}, in)
+
+		// wait for all the workers to finish, then close our respones channel
+		wg.Wait()
+		close(out)
+		swg.Done()
+	}()
+
+	h := c.DesyncHandler
+	if h == nil {
+		h = LogDesync()
+	}
+
+	// Fan-in results
+	for r := range out {
+		h.HandleDesync(r)
+		c.Checkpoint.recordTarget(r.Target, modeDesync, r.Err)
 	}
 
 	// Wait for workers to cleanup
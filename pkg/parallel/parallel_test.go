@@ -1,10 +1,41 @@
 package parallel
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler"
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
 )
 
+// startH2CServer will start a server which accepts h2c upgrades, and responds with the path
+// and the protocol of the request
+func startH2CServer(t *testing.T) *httptest.Server {
+	return startCountingH2CServer(t, new(int32))
+}
+
+// startCountingH2CServer is like startH2CServer, however the connections accepted by the
+// server are counted
+func startCountingH2CServer(t *testing.T, conns *int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Proto))
+	}), &http2.Server{}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	s.Start()
+	return s
+}
+
 func TestNew(t *testing.T) {
 	tests := []struct {
 		name string
@@ -28,14 +59,14 @@ func Test_do(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		wantR   res
+		wantR   *Result
 		wantErr bool
 	}{
 		// TODO: Add test cases.
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotR, err := do(tt.args.target)
+			gotR, err := New().do(tt.args.target)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("do() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -97,3 +128,225 @@ func TestClient_GetParallelHosts(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_ResultHandler(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	var results []*Result
+	c := New()
+	c.ResultHandler = ResultHandlerFunc(func(r *Result) {
+		results = append(results, r)
+	})
+	if err := c.GetPathsOnHost(s.URL, []string{s.URL + "/a", s.URL + "/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Target < results[j].Target })
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for i, path := range []string{"/a", "/b"} {
+		r := results[i]
+		if r.Err != nil {
+			t.Fatalf("%s: %v", path, r.Err)
+		}
+		if r.Target != s.URL+path || r.Request == nil || r.Request.URL.Path != path {
+			t.Errorf("got target %q request %v, want %s", r.Target, r.Request, path)
+		}
+		if got, want := string(r.Body), path+" HTTP/2.0"; got != want || r.Response.StatusCode != 200 {
+			t.Errorf("got status %d body %q, want 200 %q", r.Response.StatusCode, got, want)
+		}
+		if r.Duration <= 0 {
+			t.Errorf("got duration %v, want it to be recorded", r.Duration)
+		}
+	}
+}
+
+func TestClient_DiffHandler(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	var diffs []*DiffResult
+	c := New()
+	c.DiffHandler = DiffHandlerFunc(func(d *DiffResult) {
+		diffs = append(diffs, d)
+	})
+	if err := c.GetPathDiffOnHostStream(s.URL, Targets([]string{s.URL + "/a"})); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1", len(diffs))
+	}
+	d := diffs[0]
+	if d.Target != s.URL+"/a" || d.H2C == nil || d.HTTP2 == nil {
+		t.Fatalf("got diff %+v, want both results for /a", d)
+	}
+	if got, want := string(d.H2C.Body), "/a HTTP/2.0"; got != want {
+		t.Errorf("got h2c body %q, want %q", got, want)
+	}
+	if got, want := string(d.HTTP2.Body), "/a HTTP/1.1"; got != want {
+		t.Errorf("got http2 body %q, want %q", got, want)
+	}
+	// the protocol changes the body, but not its length
+	if d.Differs || d.State.H2C.Body != "/a HTTP/2.0" || d.State.Normal.Body != "/a HTTP/1.1" {
+		t.Errorf("got differs %v state %v, want only the bodies to differ", d.Differs, d.State)
+	}
+}
+
+func TestClient_MatrixHandler(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	var results []*MatrixResult
+	c := New()
+	c.UpgradeVariants = h2csmuggler.DefaultUpgradeVariants[:1]
+	c.MatrixHandler = MatrixHandlerFunc(func(r *MatrixResult) {
+		results = append(results, r)
+	})
+	if err := c.GetUpgradeMatrix([]string{s.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.Target != s.URL || r.Err != nil || len(r.Results) != 1 {
+		t.Fatalf("got result %+v, want a single variant of %s", r, s.URL)
+	}
+	if v := r.Results[0]; !v.Upgraded || !v.Stream1 {
+		t.Errorf("got variant result %+v, want upgraded with a response on stream 1", v)
+	}
+}
+
+func TestClient_DesyncHandler(t *testing.T) {
+	s := startH2CServer(t)
+	defer s.Close()
+
+	var results []*DesyncResult
+	c := New()
+	c.DesyncTechniques = []h2csmuggler.DesyncTechnique{h2csmuggler.DesyncCL}
+	c.DesyncOptions = []h2csmuggler.DesyncOption{h2csmuggler.DesyncTimeout(time.Second)}
+	c.DesyncHandler = DesyncHandlerFunc(func(r *DesyncResult) {
+		results = append(results, r)
+	})
+	if err := c.ProbeDesync([]string{s.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.Target != s.URL || r.Err != nil || len(r.Results) != 1 {
+		t.Fatalf("got result %+v, want a single technique against %s", r, s.URL)
+	}
+	// the http2 server rejects the mismatched content-length
+	if v := r.Results[0]; v.Technique != h2csmuggler.DesyncCL || v.Desyncable {
+		t.Errorf("got technique result %+v, want H2.CL not desyncable", v)
+	}
+}
+
+func TestClient_GetParallelHostsBatching(t *testing.T) {
+	paths := []string{"/a", "/b", "/c", "/d"}
+	for _, disable := range []bool{false, true} {
+		var conns int32
+		s := startCountingH2CServer(t, &conns)
+
+		var targets []string
+		for _, p := range paths {
+			targets = append(targets, s.URL+p)
+		}
+		var results []*Result
+		c := New()
+		c.DisableBatching = disable
+		c.ResultHandler = ResultHandlerFunc(func(r *Result) {
+			results = append(results, r)
+		})
+		if err := c.GetParallelHosts(targets); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		if len(results) != len(paths) {
+			t.Fatalf("got %d results, want one per target", len(results))
+		}
+		reused := 0
+		for _, r := range results {
+			if r.Err != nil {
+				t.Fatalf("%s: %v", r.Target, r.Err)
+			}
+			if got, want := string(r.Body), r.Request.URL.Path+" HTTP/2.0"; got != want {
+				t.Errorf("got body %q, want %q", got, want)
+			}
+			if r.Upgrade == nil || !r.Upgrade.Upgraded {
+				t.Errorf("%s: got upgrade %v, want the upgrade of its tunnel", r.Target, r.Upgrade)
+			}
+			if r.Reused {
+				reused++
+			}
+		}
+
+		wantConns, wantReused := 1, len(paths)-1
+		if disable {
+			wantConns, wantReused = len(paths), 0
+		}
+		if got := int(atomic.LoadInt32(&conns)); got != wantConns {
+			t.Errorf("batching disabled %v: got %d connections, want %d", disable, got, wantConns)
+		}
+		if reused != wantReused {
+			t.Errorf("batching disabled %v: got %d reused, want %d", disable, reused, wantReused)
+		}
+	}
+}
+
+func TestClient_GetParallelHostsUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "http://" + l.Addr().String()
+	l.Close()
+
+	var results []*Result
+	c := New()
+	c.ResultHandler = ResultHandlerFunc(func(r *Result) {
+		results = append(results, r)
+	})
+	if err := c.GetParallelHosts([]string{target + "/a", target + "/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want one per target", len(results))
+	}
+	for _, r := range results {
+		if failureReason(r.Err) != h2csmuggler.KindRefused {
+			t.Errorf("%s: got err %v, want refused", r.Target, r.Err)
+		}
+	}
+}
+
+func TestOriginTunnelsEviction(t *testing.T) {
+	var aConns, bConns int32
+	a := startCountingH2CServer(t, &aConns)
+	defer a.Close()
+	b := startCountingH2CServer(t, &bConns)
+	defer b.Close()
+
+	// only one idle tunnel is kept, so returning to a re-establishes its tunnel
+	o := newOriginTunnels(New(), 1)
+	defer o.Close()
+	for _, target := range []string{a.URL + "/1", a.URL + "/2", b.URL + "/1", a.URL + "/3"} {
+		if _, err := o.do(target); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+	}
+	if got := atomic.LoadInt32(&aConns); got != 2 {
+		t.Errorf("got %d connections to a, want 2", got)
+	}
+	if got := atomic.LoadInt32(&bConns); got != 1 {
+		t.Errorf("got %d connections to b, want 1", got)
+	}
+}
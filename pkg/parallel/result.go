@@ -0,0 +1,259 @@
+package parallel
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/assetnote/h2csmuggler"
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result is the outcome of requesting a target
+type Result struct {
+	Target string
+
+	// Mode is how the tunnel the request was sent over was established. One of ModeUpgrade,
+	// ModePriorKnowledge or ModeWebSocket. Only set by GetParallelHosts
+	Mode string
+
+	Request  *http.Request
+	Response *http.Response // the body has already been read and closed. See Body
+	Body     []byte
+	Err      error
+
+	// Duration is the time taken to send the request and read the response body. This
+	// includes establishing the tunnel if the request was sent on a new one
+	Duration time.Duration
+
+	// Upgrade is the result of establishing the tunnel the request was sent on, including its
+	// timings. Only set by GetParallelHosts
+	Upgrade *h2csmuggler.UpgradeResult
+
+	// Reused is whether the request was sent on a tunnel established by another target of
+	// the same origin. Only set by GetParallelHosts
+	Reused bool
+}
+
+// ResultHandler receives the results of a Client's requests
+type ResultHandler interface {
+	HandleResult(r *Result)
+}
+
+// ResultHandlerFunc is an adapter to allow a function to be used as a ResultHandler
+type ResultHandlerFunc func(r *Result)
+
+func (f ResultHandlerFunc) HandleResult(r *Result) { f(r) }
+
+// LogResults will return a handler which logs each result of a smuggled request, or prints
+// it if pretty is set
+func LogResults(pretty bool) ResultHandler {
+	return ResultHandlerFunc(func(r *Result) {
+		r.Log("h2c", pretty)
+	})
+}
+
+func (r *Result) Log(source string, PrettyPrint bool) {
+	if r.Err != nil {
+		var uscErr http2.UnexpectedStatusCodeError
+		if errors.As(r.Err, &uscErr) {
+			log.WithFields(log.Fields{
+				"status": uscErr.Code,
+				"target": r.Target,
+				"source": source,
+			}).Errorf("unexpected status code")
+		} else {
+			log.WithField("target", r.Target).WithError(r.Err).Errorf("failed")
+		}
+	} else {
+		if PrettyPrint {
+			fmt.Printf("[H2C Smuggling detected on %s]\n", r.Target)
+			if r.Err == nil {
+				fmt.Println("[Smuggled response]")
+				httpr, err := httputil.DumpResponse(r.Response, false)
+				if err != nil {
+					log.WithError(err).Errorf("failed to dump h2c rponse")
+				}
+				fmt.Printf("%s", string(httpr))
+				if log.GetLevel() != log.InfoLevel {
+					fmt.Println(string(r.Body))
+				} else {
+					fmt.Printf("[Response Body: %d bytes]\n", len(r.Body))
+				}
+			} else {
+				fmt.Println("[Smuggled Error]")
+				fmt.Println(r.Err)
+				fmt.Println()
+			}
+
+		} else {
+			log.WithFields(log.Fields{
+				"status":  r.Response.StatusCode,
+				"headers": r.Response.Header,
+				"body":    len(r.Body),
+				"target":  r.Target,
+				"source":  source,
+			}).Infof("success")
+		}
+	}
+}
+
+// LogHostResults will return a handler which logs the result of checking each target, as
+// reported by GetParallelHosts
+func LogHostResults() ResultHandler {
+	return ResultHandlerFunc(func(r *Result) {
+		if r.Err != nil {
+			var uscErr http2.UnexpectedStatusCodeError
+			if errors.As(r.Err, &uscErr) {
+				log.WithFields(log.Fields{
+					"status":  uscErr.Code,
+					"target":  r.Target,
+					"mode":    r.Mode,
+					"reason":  failureReason(r.Err),
+					"reused":  r.Reused,
+					"upgrade": r.Upgrade,
+				}).Errorf("unexpected status code")
+			} else {
+				log.WithFields(log.Fields{
+					"target":  r.Target,
+					"mode":    r.Mode,
+					"reason":  failureReason(r.Err),
+					"reused":  r.Reused,
+					"upgrade": r.Upgrade,
+				}).WithError(r.Err).Debugf("failed")
+			}
+			return
+		}
+
+		switch log.GetLevel() {
+		case log.DebugLevel:
+			log.WithFields(log.Fields{
+				"status":  r.Response.StatusCode,
+				"body":    r.Body,
+				"target":  r.Target,
+				"mode":    r.Mode,
+				"headers": r.Response.Header,
+				"reused":  r.Reused,
+				"upgrade": r.Upgrade,
+			}).Infof("success")
+		default:
+			log.WithFields(log.Fields{
+				"status":  r.Response.StatusCode,
+				"body":    len(r.Body),
+				"target":  r.Target,
+				"mode":    r.Mode,
+				"headers": r.Response.Header,
+				"reused":  r.Reused,
+				"upgrade": r.Upgrade,
+			}).Infof("success")
+		}
+	})
+}
+
+// MatrixResult is the outcome of trying each upgrade variant against a target
+type MatrixResult struct {
+	Target string
+
+	// Results are the outcome of each variant, in the order they were tried
+	Results []h2csmuggler.UpgradeVariantResult
+
+	// Err is why the variants could not be tried at all. Failures of each variant are
+	// reported on its result
+	Err error
+}
+
+// MatrixHandler receives the results of GetUpgradeMatrix
+type MatrixHandler interface {
+	HandleMatrix(r *MatrixResult)
+}
+
+// MatrixHandlerFunc is an adapter to allow a function to be used as a MatrixHandler
+type MatrixHandlerFunc func(r *MatrixResult)
+
+func (f MatrixHandlerFunc) HandleMatrix(r *MatrixResult) { f(r) }
+
+// LogMatrix will return a handler which logs the result of each variant against each target
+func LogMatrix() MatrixHandler {
+	return MatrixHandlerFunc(func(r *MatrixResult) {
+		if r.Err != nil {
+			log.WithField("target", r.Target).WithError(r.Err).Errorf("failed")
+			return
+		}
+		for _, v := range r.Results {
+			fields := log.Fields{
+				"target":   r.Target,
+				"variant":  v.Variant.Name,
+				"upgraded": v.Upgraded,
+				"stream1":  v.Stream1,
+				"status":   v.StatusCode,
+				"upgrade":  v.Result,
+			}
+			if v.Stream1 {
+				log.WithFields(fields).Infof("success")
+			} else if v.Upgraded {
+				log.WithFields(fields).WithError(v.Err).Warnf("upgraded without a response on stream 1")
+			} else {
+				log.WithFields(fields).WithError(v.Err).Infof("not upgraded")
+			}
+		}
+	})
+}
+
+// DesyncResult is the outcome of probing the hop behind the tunnel to a target with each
+// desync technique
+type DesyncResult struct {
+	Target string
+
+	// Results are the outcome of each technique, in the order they were tried
+	Results []h2csmuggler.DesyncResult
+
+	// Err is why the target could not be probed at all. Failures of each technique are
+	// reported on its result
+	Err error
+}
+
+// DesyncHandler receives the results of ProbeDesync
+type DesyncHandler interface {
+	HandleDesync(r *DesyncResult)
+}
+
+// DesyncHandlerFunc is an adapter to allow a function to be used as a DesyncHandler
+type DesyncHandlerFunc func(r *DesyncResult)
+
+func (f DesyncHandlerFunc) HandleDesync(r *DesyncResult) { f(r) }
+
+// LogDesync will return a handler which logs the result of each technique against each target
+func LogDesync() DesyncHandler {
+	return DesyncHandlerFunc(func(r *DesyncResult) {
+		if r.Err != nil {
+			log.WithField("target", r.Target).WithError(r.Err).Errorf("failed")
+			return
+		}
+		for _, v := range r.Results {
+			fields := log.Fields{
+				"target":            r.Target,
+				"technique":         v.Technique,
+				"baseline_status":   v.BaselineStatus,
+				"baseline_duration": v.BaselineDuration.String(),
+				"timing_status":     v.TimingStatus,
+				"timing_duration":   v.TimingDuration.String(),
+				"timed_out":         v.TimedOut,
+				"target_status":     v.TargetStatus,
+				"smuggled_status":   v.SmuggledStatus,
+				"follow_up_status":  v.FollowUpStatus,
+				"control_status":    v.ControlStatus,
+				"poisoned":          v.Poisoned,
+			}
+			if v.Err != nil {
+				log.WithFields(fields).WithError(v.Err).Errorf("probe failed")
+			} else if v.Desyncable {
+				log.WithFields(fields).Infof("desyncable")
+			} else {
+				log.WithFields(fields).Infof("not desyncable")
+			}
+		}
+	})
+}
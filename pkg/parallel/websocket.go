@@ -0,0 +1,116 @@
+package parallel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/assetnote/h2csmuggler"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// webSocketTunnels sends requests through a fixed number of websocket tunnels to base. Each
+// tunnel carries one request at a time, so requests wait for a free tunnel. Tunnels which fail
+// are re-established with the base request by the next request to use them
+type webSocketTunnels struct {
+	base   string
+	muts   []RequestMutation
+	opts   []h2csmuggler.ConnectionOption
+	limits *limits
+
+	// free holds the tunnels which are not in use. A nil tunnel is a slot which needs to
+	// be re-established
+	free chan *h2csmuggler.WebSocketTunnel
+}
+
+// openWebSocketTunnels will establish n websocket tunnels to base concurrently, and return
+// once they all have completed
+func (c *Client) openWebSocketTunnels(base string, n int, o *ParallelOptions) *webSocketTunnels {
+	if o.RawHeaders != nil || o.PseudoHeaders != nil {
+		log.Warnf("raw headers and pseudo-headers are not sent over websocket tunnels")
+	}
+	t := &webSocketTunnels{
+		base:   base,
+		muts:   o.RequestMutations,
+		opts:   c.tunnelOptions(base),
+		limits: c.limits(),
+		free:   make(chan *h2csmuggler.WebSocketTunnel, n),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tun, err := t.open(context.Background())
+			if err != nil {
+				log.WithField("target", base).WithError(err).Tracef("failed to request")
+			}
+			t.free <- tun
+		}()
+	}
+	wg.Wait()
+	return t
+}
+
+// open will establish a new tunnel with the base request, discarding its response. The dial
+// waits for the client's limits, and a response asking us to slow down starts a cool-down
+func (t *webSocketTunnels) open(ctx context.Context) (*h2csmuggler.WebSocketTunnel, error) {
+	tun, err := h2csmuggler.NewWebSocketTunnel(t.base, t.opts...)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(t.base, t.muts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tun.DoUpgradeContext(ctx, req)
+	t.limits.observe(&Result{Target: t.base, Response: res, Err: err})
+	if err != nil {
+		tun.Close()
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return tun, nil
+}
+
+// Do will send the request over the next free tunnel
+func (t *webSocketTunnels) Do(req *http.Request) (*http.Response, error) {
+	tun := <-t.free
+	defer func() {
+		t.free <- tun
+	}()
+
+	if tun == nil {
+		var err error
+		tun, err = t.open(req.Context())
+		if err != nil {
+			return nil, errors.Wrap(err, "connect")
+		}
+	}
+	res, err := tun.Do(req)
+	if err != nil {
+		// the socket is in an unknown state, so the tunnel is re-established next time
+		tun.Close()
+		tun = nil
+	}
+	return res, err
+}
+
+// Close will close the free tunnels. This must only be called once no requests are in flight
+func (t *webSocketTunnels) Close() {
+	for {
+		select {
+		case tun := <-t.free:
+			if tun != nil {
+				tun.Close()
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package h2csmuggler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	DefaultPoolIdleTimeout  = 90 * time.Second
+	DefaultPoolPingInterval = 15 * time.Second
+	DefaultPoolPingTimeout  = 5 * time.Second
+
+	// DefaultPoolRetireTimeout is how long in-flight streams on a replaced tunnel are given to
+	// complete before the tunnel is closed
+	DefaultPoolRetireTimeout = 30 * time.Second
+
+	ErrPoolClosed = errors.New("h2csmuggler: pool closed")
+)
+
+type PoolOption func(p *Pool)
+
+// PoolConnectionOptions will apply opts to every Conn created by the pool
+func PoolConnectionOptions(opts ...ConnectionOption) PoolOption {
+	return func(p *Pool) {
+		p.connOpts = append(p.connOpts, opts...)
+	}
+}
+
+// PoolMaxConns sets the number of tunnels kept for each origin and upgrade profile.
+// Requests are spread across the tunnels round robin
+func PoolMaxConns(v int) PoolOption {
+	return func(p *Pool) {
+		p.maxConns = v
+	}
+}
+
+// PoolIdleTimeout will re-upgrade tunnels which have not been used for longer than v,
+// rather than risk them having been closed by the server. 0 disables the idle timeout
+func PoolIdleTimeout(v time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.idleTimeout = v
+	}
+}
+
+// PoolHealthCheck will ping tunnels which have not been used for longer than interval
+// before handing them out. Tunnels which fail to respond within timeout are re-upgraded.
+// An interval of 0 disables the health check
+func PoolHealthCheck(interval time.Duration, timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.pingInterval = interval
+		p.pingTimeout = timeout
+	}
+}
+
+// Pool hands out upgraded Conns, keyed by the origin (scheme, host and port) and the
+// upgrade profile used to establish them. Tunnels are transparently re-upgraded when the
+// server sends a GOAWAY, the tunnel hits the idle timeout or it fails the ping health check.
+// Conns handed out by the pool are owned by the pool, and must not be closed by the caller.
+// Pool is safe for concurrent use
+type Pool struct {
+	connOpts     []ConnectionOption
+	maxConns     int
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	mu      sync.Mutex
+	tunnels map[poolKey]*poolTunnels
+	closed  bool
+}
+
+// poolKey identifies a set of interchangeable tunnels
+type poolKey struct {
+	origin  string
+	profile UpgradeOptions
+}
+
+type poolTunnels struct {
+	next  uint32 // round robin counter
+	slots []*poolSlot
+}
+
+// poolSlot holds a single tunnel. The conn is replaced whenever it is no longer usable
+type poolSlot struct {
+	mu       sync.Mutex
+	conn     *Conn
+	lastUsed time.Time
+}
+
+// NewPool will return an empty pool. Tunnels are created and upgraded on first use
+func NewPool(opts ...PoolOption) *Pool {
+	p := &Pool{
+		maxConns:     1,
+		idleTimeout:  DefaultPoolIdleTimeout,
+		pingInterval: DefaultPoolPingInterval,
+		pingTimeout:  DefaultPoolPingTimeout,
+		tunnels:      make(map[poolKey]*poolTunnels),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.maxConns < 1 {
+		p.maxConns = 1
+	}
+	return p
+}
+
+// Close will close every tunnel in the pool. After this is called, the pool is no
+// longer safe to use
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, t := range p.tunnels {
+		for _, s := range t.slots {
+			s.mu.Lock()
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// origin will return the scheme://host:port of the url, inferring the port from the scheme
+func origin(u *url.URL) (string, error) {
+	port := u.Port()
+	switch u.Scheme {
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return "", ErrUnexpectedScheme
+	}
+	return fmt.Sprintf("%s://%s:%s", u.Scheme, u.Hostname(), port), nil
+}
+
+// slot will return the next tunnel slot to use for the url and upgrade profile
+func (p *Pool) slot(u *url.URL, opts []UpgradeOption) (*poolSlot, string, error) {
+	o, err := origin(u)
+	if err != nil {
+		return nil, "", err
+	}
+	key := poolKey{origin: o, profile: newUpgradeOptions(opts...)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, "", ErrPoolClosed
+	}
+	t, ok := p.tunnels[key]
+	if !ok {
+		t = &poolTunnels{slots: make([]*poolSlot, p.maxConns)}
+		for i := range t.slots {
+			t.slots[i] = &poolSlot{}
+		}
+		p.tunnels[key] = t
+	}
+	i := atomic.AddUint32(&t.next, 1) - 1
+	return t.slots[int(i)%len(t.slots)], o, nil
+}
+
+// acquire will return the slot's conn, replacing it if it is no longer usable. The
+// returned conn may not yet be upgraded
+func (p *Pool) acquire(ctx context.Context, s *poolSlot, origin string) (*Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !p.healthy(ctx, s) {
+		s.conn.retire(DefaultPoolRetireTimeout)
+		s.conn = nil
+	}
+	if s.conn == nil {
+		c, err := NewConn(origin, p.connOpts...)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	s.lastUsed = time.Now()
+	return s.conn, nil
+}
+
+// healthy reports whether the slot's conn can be handed out. The slot lock must be held
+func (p *Pool) healthy(ctx context.Context, s *poolSlot) bool {
+	c := s.conn
+	// the next request will perform the upgrade
+	if !c.Initialized() {
+		return true
+	}
+	logger := log.WithField("url", c.url)
+	if !c.canTakeNewRequest() {
+		logger.Debugf("tunnel closed or received goaway. re-upgrading")
+		return false
+	}
+
+	idle := time.Since(s.lastUsed)
+	if p.idleTimeout != 0 && idle > p.idleTimeout {
+		logger.WithField("idle", idle).Debugf("tunnel idle timeout. re-upgrading")
+		return false
+	}
+	if p.pingInterval != 0 && idle > p.pingInterval {
+		ctx, cancel := context.WithTimeout(ctx, p.pingTimeout)
+		defer cancel()
+		if err := c.Ping(ctx); err != nil {
+			logger.WithError(err).Debugf("tunnel failed health check. re-upgrading")
+			return false
+		}
+	}
+	return true
+}
+
+// Get will return an upgraded Conn for the origin of req and the upgrade profile in opts.
+// If there is no usable tunnel, a new one is upgraded with req and the response discarded.
+// Requests sent with the returned Conn are not bound to the origin, allowing for any host
+// to be smuggled through the tunnel
+func (p *Pool) Get(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*Conn, error) {
+	s, o, err := p.slot(req.URL, opts)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.acquire(ctx, s, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.lockUpgrade(ctx); err != nil {
+		return nil, err
+	}
+	defer c.unlockUpgrade()
+	if c.Initialized() {
+		return c, nil
+	}
+
+	res, err := c.upgrade(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return c, nil
+}
+
+// Do will perform the request over a pooled tunnel for the request's origin, using the
+// default upgrade profile. See DoContext
+func (p *Pool) Do(req *http.Request) (*http.Response, error) {
+	return p.DoContext(req.Context(), req)
+}
+
+// DoContext will perform the request over a pooled tunnel for the request's origin and the
+// upgrade profile in opts. If the tunnel has not been upgraded yet, the request is used to
+// upgrade it. If the tunnel dies while the request is in flight, the request is retried once
+// on a new tunnel when its body can be replayed
+func (p *Pool) DoContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
+	s, o, err := p.slot(req.URL, opts)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.acquire(ctx, s, o)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.doContext(ctx, req, opts...)
+	if err == nil || ctx.Err() != nil || !c.Initialized() || c.canTakeNewRequest() {
+		return res, err
+	}
+
+	// the tunnel was lost mid request
+	retry, rerr := rewindRequest(req)
+	if rerr != nil {
+		return nil, err
+	}
+	log.WithField("url", c.url).WithError(err).Debugf("tunnel lost. retrying request")
+	c, err = p.acquire(ctx, s, o)
+	if err != nil {
+		return nil, err
+	}
+	return c.doContext(ctx, retry, opts...)
+}
@@ -0,0 +1,136 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
+)
+
+// startCountingH2CServer will start a h2c server which counts the connections it accepts
+func startCountingH2CServer(t *testing.T, conns *int32) *httptest.Server {
+	s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	countConns(s, conns)
+	s.Start()
+	return s
+}
+
+func poolDo(t *testing.T, p *Pool, target string, opts ...UpgradeOption) {
+	t.Helper()
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.DoContext(context.Background(), req, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("got body %q, want HTTP/2.0", body)
+	}
+}
+
+func TestPoolReusesTunnel(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	p := NewPool()
+	defer p.Close()
+	for i := 0; i < 5; i++ {
+		poolDo(t, p, s.URL+"/")
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+
+	// a different upgrade profile gets its own tunnel
+	poolDo(t, p, s.URL+"/", SetUpgradeHeader("H2C"))
+	if got := atomic.LoadInt32(&conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestPoolReupgradesClosedTunnel(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	p := NewPool()
+	defer p.Close()
+	req, err := http.NewRequest("GET", s.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.Get(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate the tunnel being dropped. This must not leak to the next caller
+	c.conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for c.canTakeNewRequest() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	poolDo(t, p, s.URL+"/")
+	if got := atomic.LoadInt32(&conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	p := NewPool(PoolIdleTimeout(20 * time.Millisecond))
+	defer p.Close()
+	poolDo(t, p, s.URL+"/")
+	time.Sleep(50 * time.Millisecond)
+	poolDo(t, p, s.URL+"/")
+	if got := atomic.LoadInt32(&conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	p := NewPool(PoolHealthCheck(time.Nanosecond, time.Second))
+	defer p.Close()
+	for i := 0; i < 3; i++ {
+		poolDo(t, p, s.URL+"/")
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("got %d connections, want 1", got)
+	}
+}
+
+func TestPoolMaxConns(t *testing.T) {
+	var conns int32
+	s := startCountingH2CServer(t, &conns)
+	defer s.Close()
+
+	p := NewPool(PoolMaxConns(3))
+	defer p.Close()
+	for i := 0; i < 6; i++ {
+		poolDo(t, p, s.URL+"/")
+	}
+	if got := atomic.LoadInt32(&conns); got != 3 {
+		t.Errorf("got %d connections, want 3", got)
+	}
+}
@@ -0,0 +1,293 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrUnexpectedProxyScheme = errors.New("h2csmuggler: unexpected scheme for proxy")
+)
+
+// ProxyConnectError is returned when the upstream proxy refuses the CONNECT request
+type ProxyConnectError struct {
+	Code   int
+	Status string
+}
+
+func (p ProxyConnectError) Error() string {
+	return fmt.Sprintf("h2csmuggler: proxy CONNECT failed: %v", p.Status)
+}
+
+// ConnectionProxy will route all connections through the upstream proxy. Supported schemes are
+// http and https for HTTP CONNECT proxies, and socks5 or socks5h for SOCKS5 proxies. Credentials
+// in the url userinfo are sent as basic auth for CONNECT, and as username/password for SOCKS5.
+// Following curl, socks5 resolves the target hostname locally with the configured resolver
+// (or the dialer's resolver, as for direct connections) and sends the proxy its address, while socks5h and CONNECT proxies are
+// sent the hostname to resolve. Resolve overrides from ConnectionResolveOverride are applied
+// in every case. A nil url disables the proxy
+func ConnectionProxy(u *url.URL) ConnectionOption {
+	return func(c *Conn) {
+		c.proxy = u
+	}
+}
+
+// ConnectionNoProxy will dial the hosts directly rather than through the proxy. Hosts follow
+// the NO_PROXY conventions: "*" matches every host, an ip or cidr matches ip targets, a domain
+// matches itself and its subdomains (with or without a leading "."), and any entry may be
+// restricted to a port with :port
+func ConnectionNoProxy(hosts ...string) ConnectionOption {
+	return func(c *Conn) {
+		c.noProxy = append(c.noProxy, hosts...)
+	}
+}
+
+// ProxyFromEnvironment will return the proxy url from the HTTPS_PROXY or ALL_PROXY environment
+// variables (or their lowercase versions). If neither are set, nil is returned.
+// Since smuggling requires a raw tunnel, the proxy is used for both http and https targets.
+// The hosts to exclude from the proxy are returned by NoProxyFromEnvironment
+func ProxyFromEnvironment() (*url.URL, error) {
+	for _, k := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"} {
+		v := os.Getenv(k)
+		if v == "" {
+			continue
+		}
+		return ParseProxy(v)
+	}
+	return nil, nil
+}
+
+// NoProxyFromEnvironment will return the comma separated hosts of the NO_PROXY environment
+// variable (or its lowercase version), for use with ConnectionNoProxy
+func NoProxyFromEnvironment() []string {
+	for _, k := range []string{"NO_PROXY", "no_proxy"} {
+		v := os.Getenv(k)
+		if v == "" {
+			continue
+		}
+		var hosts []string
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		return hosts
+	}
+	return nil
+}
+
+// bypassProxy will return whether hostport matches one of the connection's no proxy hosts
+func (c *Conn) bypassProxy(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, p := range c.noProxy {
+		p = strings.ToLower(p)
+		if p == "*" {
+			return true
+		}
+		if h, pp, err := net.SplitHostPort(p); err == nil {
+			if pp != port {
+				continue
+			}
+			p = h
+		}
+		p = strings.TrimSuffix(strings.TrimPrefix(p, "["), "]")
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(p); err == nil {
+				if cidr.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		p = strings.TrimPrefix(p, ".")
+		if p != "" && (host == p || strings.HasSuffix(host, "."+p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProxy will parse the proxy url. If no scheme is provided, http is assumed
+func ParseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		// try again with a scheme, e.g. for proxy.corp:8080
+		u, err = url.Parse("http://" + s)
+		if err != nil {
+			return nil, errors.Wrap(err, "h2csmuggler: failed to parse proxy")
+		}
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, ErrUnexpectedProxyScheme
+	}
+	return u, nil
+}
+
+// DialContext will dial addr using the connection's dialer, resolver and proxy configuration.
+// This does not use or modify the state of the conn, and can be used to make other clients
+// connect the same way as the conn e.g. as http.Transport.DialContext
+func (c *Conn) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := *c.dialer
+	if c.timeouts.Dial != 0 {
+		dialer.Timeout = c.timeouts.Dial
+	}
+	return c.dialContext(ctx, &dialer, network, addr)
+}
+
+// dialContext will dial the hostport, through the proxy if one is configured
+func (c *Conn) dialContext(ctx context.Context, dialer *net.Dialer, network, hostport string) (net.Conn, error) {
+	if c.proxy == nil || c.bypassProxy(hostport) {
+		return c.dialDirect(ctx, dialer, network, hostport)
+	}
+
+	// let the proxy resolve the host, unless we've been told otherwise. socks5 resolves locally below
+	if addr, ok := c.resolveOverrides[hostport]; ok {
+		_, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return nil, err
+		}
+		hostport = net.JoinHostPort(addr, port)
+	}
+
+	log.WithFields(log.Fields{
+		"proxy": c.proxy.Host,
+		"addr":  hostport,
+	}).Tracef("dialing through proxy")
+	switch c.proxy.Scheme {
+	case "http", "https":
+		return c.dialConnect(ctx, dialer, hostport)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if c.proxy.User != nil {
+			auth = &proxy.Auth{User: c.proxy.User.Username()}
+			auth.Password, _ = c.proxy.User.Password()
+		}
+		forward := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.dialDirect(ctx, dialer, network, addr)
+		})
+		d, err := proxy.SOCKS5("tcp", c.proxy.Host, auth, forward)
+		if err != nil {
+			return nil, errors.Wrap(err, "h2csmuggler: socks5 proxy")
+		}
+		socks := d.(proxy.ContextDialer)
+		if c.proxy.Scheme == "socks5h" {
+			return socks.DialContext(ctx, network, hostport)
+		}
+		return c.dialResolved(ctx, dialer, hostport, func(ctx context.Context, addr string) (net.Conn, error) {
+			return socks.DialContext(ctx, network, addr)
+		})
+	default:
+		return nil, ErrUnexpectedProxyScheme
+	}
+}
+
+// dialConnect will establish a tunnel to hostport through the HTTP CONNECT proxy
+func (c *Conn) dialConnect(ctx context.Context, dialer *net.Dialer, hostport string) (net.Conn, error) {
+	proxyHostport := c.proxy.Host
+	if c.proxy.Port() == "" {
+		port := 80
+		if c.proxy.Scheme == "https" {
+			port = 443
+		}
+		proxyHostport = fmt.Sprintf("%s:%d", c.proxy.Host, port)
+	}
+
+	conn, err := c.dialDirect(ctx, dialer, "tcp", proxyHostport)
+	if err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: failed to dial proxy")
+	}
+
+	if c.proxy.Scheme == "https" {
+		tlsconn := tls.Client(conn, &tls.Config{
+			ServerName:         c.proxy.Hostname(),
+			InsecureSkipVerify: true,
+		})
+		err = withDeadline(ctx, conn, c.timeouts.TLSHandshake, tlsconn.Handshake)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "h2csmuggler: failed to dial proxy tls")
+		}
+		conn = tlsconn
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: make(http.Header),
+	}
+	if c.proxy.User != nil {
+		password, _ := c.proxy.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(c.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	br := bufio.NewReader(conn)
+	err = withDeadline(ctx, conn, c.timeouts.Dial, func() error {
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return ProxyConnectError{Code: res.StatusCode, Status: res.Status}
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "h2csmuggler: proxy CONNECT")
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialerFunc adapts a dial function to proxy.Dialer and proxy.ContextDialer
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// bufferedConn is a net.Conn which first drains data that was already read off the conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
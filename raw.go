@@ -0,0 +1,66 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"net/http"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// RawUpgrade is a HTTP/1.1 upgrade request template which is written to the connection
+// byte for byte. Unlike a http.Request, the template can contain duplicate or folded headers,
+// unusual whitespace and absolute-form request targets, along with any line endings.
+// The template is a text/template, executed with RawUpgradeData for the request
+type RawUpgrade struct {
+	tmpl *template.Template
+}
+
+// RawUpgradeData is available to the template when rendering the upgrade request
+type RawUpgradeData struct {
+	Method        string // e.g. GET
+	Host          string // the host header, or the url host if unset
+	Path          string // the origin-form request target e.g. /foo?bar=baz
+	URL           string // the absolute-form request target e.g. http://example.com/foo
+	HTTP2Settings string // the HTTP2-Settings header value from the upgrade options
+}
+
+// ParseRawUpgrade will parse the raw upgrade template. Line endings are kept as is, so
+// requests should use \r\n unless bare newlines are intentional
+func ParseRawUpgrade(text string) (*RawUpgrade, error) {
+	tmpl, err := template.New("upgrade").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: invalid raw upgrade")
+	}
+	return &RawUpgrade{tmpl: tmpl}, nil
+}
+
+// Render will return the raw upgrade request for req
+func (r *RawUpgrade) Render(req *http.Request, o UpgradeOptions) ([]byte, error) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	data := RawUpgradeData{
+		Method:        req.Method,
+		Host:          host,
+		Path:          req.URL.RequestURI(),
+		URL:           req.URL.String(),
+		HTTP2Settings: o.HTTP2SettingsHeader,
+	}
+
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, data); err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: failed to render raw upgrade")
+	}
+	return buf.Bytes(), nil
+}
+
+// UpgradeRaw will write the raw template as the upgrade request instead of serializing the
+// request. The request is still used to fill the template and describes the request on
+// stream 1. All other upgrade options, other than the HTTP2-Settings value, are ignored
+func UpgradeRaw(r *RawUpgrade) UpgradeOption {
+	return func(o *UpgradeOptions) {
+		o.Raw = r
+	}
+}
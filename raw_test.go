@@ -0,0 +1,107 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
+)
+
+// recordingListener records everything read from the connections it accepts
+type recordingListener struct {
+	net.Listener
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: c, l: l}, nil
+}
+
+func (l *recordingListener) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte{}, l.buf.Bytes()...)
+}
+
+type recordingConn struct {
+	net.Conn
+	l *recordingListener
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.l.mu.Lock()
+	c.l.buf.Write(b[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+func TestConnUpgradeRaw(t *testing.T) {
+	var dup []string
+	s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dup = r.Header["X-Dup"]
+		w.Write([]byte(r.Proto + " " + r.URL.Path))
+	}), &http2.Server{}))
+	l := &recordingListener{Listener: s.Listener}
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	raw, err := ParseRawUpgrade("GET {{.Path}} HTTP/1.1\r\n" +
+		"host: {{.Host}}\r\n" +
+		"x-dup: a\r\n" +
+		"x-dup: b\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Connection: HTTP2-Settings\r\n" +
+		"upgrade:   h2c\r\n" +
+		"HTTP2-Settings: {{.HTTP2Settings}}\r\n" +
+		"\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL+"/raw", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.DoUpgrade(req, UpgradeRaw(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if got, want := string(body), "HTTP/2.0 /raw"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if len(dup) != 2 {
+		t.Errorf("got X-Dup %q, want both values", dup)
+	}
+
+	want := "GET /raw HTTP/1.1\r\nhost: " + strings.TrimPrefix(s.URL, "http://") + "\r\nx-dup: a\r\n"
+	if got := l.Bytes(); !bytes.HasPrefix(got, []byte(want)) {
+		t.Errorf("got request %q, want prefix %q", got, want)
+	}
+}
+
+func TestParseRawUpgradeInvalid(t *testing.T) {
+	if _, err := ParseRawUpgrade("GET {{.Path HTTP/1.1\r\n\r\n"); err == nil {
+		t.Errorf("expected an error for an unterminated action")
+	}
+}
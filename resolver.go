@@ -0,0 +1,248 @@
+package h2csmuggler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolver will lookup the addresses of a host. *net.Resolver satisfies this interface
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+var (
+	// SystemResolver will resolve hosts using the operating system's configuration
+	SystemResolver Resolver = net.DefaultResolver
+)
+
+// NewResolver will return a resolver which queries the provided nameservers over udp.
+// Servers may be provided as ip or ip:port, where the port defaults to 53. Each query
+// will rotate through the servers, so a failing server will be retried on the next.
+// Queries are bounded by the context of the lookup, which is the dial timeout when
+// resolving for a Conn
+func NewResolver(servers ...string) (*net.Resolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("h2csmuggler: no nameservers provided")
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		addrs = append(addrs, s)
+	}
+
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			addr := addrs[(atomic.AddUint32(&next, 1)-1)%uint32(len(addrs))]
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}, nil
+}
+
+// CachingResolver will cache successful lookups from the underlying resolver for the TTL.
+// Concurrent lookups of the same host will share a single query. A CachingResolver is safe
+// for concurrent use, and should be shared between connections to benefit from the cache
+type CachingResolver struct {
+	Resolver Resolver
+	TTL      time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]cachedLookup
+	inflight map[string]*lookupCall
+}
+
+type cachedLookup struct {
+	addrs   []string
+	expires time.Time
+}
+
+type lookupCall struct {
+	done  chan struct{}
+	addrs []string
+	err   error
+
+	// guarded by CachingResolver.mu
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewCachingResolver will return a resolver that caches the lookups of r for the ttl
+func NewCachingResolver(r Resolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		Resolver: r,
+		TTL:      ttl,
+	}
+}
+
+// LookupHost will return the cached addresses for the host, or perform the lookup
+func (r *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]cachedLookup)
+		r.inflight = make(map[string]*lookupCall)
+	}
+	if c, ok := r.cache[host]; ok && time.Now().Before(c.expires) {
+		r.mu.Unlock()
+		return c.addrs, nil
+	}
+	call, ok := r.inflight[host]
+	if !ok {
+		lctx, cancel := context.WithCancel(context.Background())
+		call = &lookupCall{done: make(chan struct{}), cancel: cancel}
+		r.inflight[host] = call
+		go r.lookup(lctx, host, call)
+	}
+	call.waiters++
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.addrs, call.err
+	case <-ctx.Done():
+		r.leave(host, call)
+		return nil, ctx.Err()
+	}
+}
+
+// leave will stop waiting on the shared lookup. The lookup is cancelled once no callers are
+// waiting on it, so it is bounded by the longest of their contexts
+func (r *CachingResolver) leave(host string, call *lookupCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		// later callers start a new lookup, rather than joining the cancelled one
+		if r.inflight[host] == call {
+			delete(r.inflight, host)
+		}
+		call.cancel()
+	}
+}
+
+// lookup will perform the shared lookup for host. This is detached from the callers context
+// so that a cancelled caller does not fail the other callers waiting on the same host
+func (r *CachingResolver) lookup(ctx context.Context, host string, call *lookupCall) {
+	defer call.cancel()
+	call.addrs, call.err = r.Resolver.LookupHost(ctx, host)
+
+	r.mu.Lock()
+	if r.inflight[host] == call {
+		delete(r.inflight, host)
+	}
+	if call.err == nil {
+		r.cache[host] = cachedLookup{
+			addrs:   call.addrs,
+			expires: time.Now().Add(r.TTL),
+		}
+	}
+	r.mu.Unlock()
+	close(call.done)
+}
+
+// ParseResolveOverride will parse a curl style override of host:port:addr, returning the
+// host:port to override and the address to use in its place
+func ParseResolveOverride(s string) (hostport string, addr string, err error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("h2csmuggler: invalid resolve override %q, expected host:port:addr", s)
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+	if net.ParseIP(addr) == nil {
+		return "", "", fmt.Errorf("h2csmuggler: invalid address in resolve override %q", s)
+	}
+	return net.JoinHostPort(parts[0], parts[1]), addr, nil
+}
+
+// dialDirect will dial the hostport, applying any resolve overrides and the configured
+// resolver. If no resolver is configured, resolution is left to the dialer
+func (c *Conn) dialDirect(ctx context.Context, dialer *net.Dialer, network, hostport string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.resolveOverrides[hostport]; !ok && (c.resolver == nil || net.ParseIP(host) != nil) {
+		return dialer.DialContext(ctx, network, hostport)
+	}
+	return c.dialResolved(ctx, dialer, hostport, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// dialResolved will resolve the host of hostport, applying any resolve overrides and the
+// configured resolver, falling back to the dialer's resolver then SystemResolver, then dial
+// each address in turn until one connects
+func (c *Conn) dialResolved(ctx context.Context, dialer *net.Dialer, hostport string, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	// bound the lookup and the dials by the dial timeout, as the dialer would if it resolved
+	// the host itself
+	if dialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	var addrs []string
+	if addr, ok := c.resolveOverrides[hostport]; ok {
+		log.WithFields(log.Fields{
+			"host": hostport,
+			"addr": addr,
+		}).Tracef("using resolve override")
+		addrs = []string{addr}
+	} else if net.ParseIP(host) != nil {
+		addrs = []string{host}
+	} else {
+		// resolve the same way as a direct dial would without a configured resolver
+		resolver := c.resolver
+		if resolver == nil && dialer.Resolver != nil {
+			resolver = dialer.Resolver
+		}
+		if resolver == nil {
+			resolver = SystemResolver
+		}
+		addrs, err = resolver.LookupHost(ctx, host)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) {
+				return nil, err
+			}
+			return nil, &net.DNSError{
+				Err:  err.Error(),
+				Name: host,
+			}
+		}
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dial(ctx, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, firstErr
+}
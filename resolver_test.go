@@ -0,0 +1,168 @@
+package h2csmuggler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	calls int32
+	addrs []string
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	atomic.AddInt32(&r.calls, 1)
+	time.Sleep(10 * time.Millisecond)
+	return r.addrs, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	r := &countingResolver{addrs: []string{"127.0.0.1"}}
+	cr := NewCachingResolver(r, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := cr.LookupHost(context.Background(), "example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+				t.Errorf("got addrs %v", addrs)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := cr.LookupHost(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&r.calls); got != 1 {
+		t.Errorf("got %d lookups, want 1", got)
+	}
+}
+
+func TestParseResolveOverride(t *testing.T) {
+	tests := []struct {
+		in           string
+		wantHostport string
+		wantAddr     string
+		wantErr      bool
+	}{
+		{in: "example.com:443:127.0.0.1", wantHostport: "example.com:443", wantAddr: "127.0.0.1"},
+		{in: "example.com:80:[::1]", wantHostport: "example.com:80", wantAddr: "::1"},
+		{in: "example.com:443", wantErr: true},
+		{in: "example.com:443:notanip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			hostport, addr, err := ParseResolveOverride(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResolveOverride() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if hostport != tt.wantHostport || addr != tt.wantAddr {
+				t.Errorf("ParseResolveOverride() = %v, %v, want %v, %v", hostport, addr, tt.wantHostport, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestConnResolveOverride(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := "http://smuggler.invalid:" + port + "/"
+	c, err := NewConn(target,
+		ConnectionResolveOverride("smuggler.invalid:"+port, host),
+		// any lookup would fail, so this proves the override was used
+		ConnectionResolver(&countingResolver{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+// blockingResolver blocks each lookup until its context is done, recording the deadline
+type blockingResolver struct {
+	deadlines chan time.Time
+	cancelled chan error
+}
+
+func (r *blockingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	deadline, _ := ctx.Deadline()
+	r.deadlines <- deadline
+	<-ctx.Done()
+	r.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestCachingResolverCancel(t *testing.T) {
+	r := &blockingResolver{deadlines: make(chan time.Time, 1), cancelled: make(chan error, 1)}
+	cr := NewCachingResolver(r, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cr.LookupHost(ctx, "example.com"); err == nil {
+		t.Fatal("expected the lookup to time out")
+	}
+	// the shared lookup should be cancelled once its only caller has given up
+	select {
+	case <-r.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("shared lookup was not cancelled")
+	}
+}
+
+func TestConnResolveDialTimeout(t *testing.T) {
+	r := &blockingResolver{deadlines: make(chan time.Time, 1), cancelled: make(chan error, 1)}
+	c, err := NewConn("http://smuggler.invalid/",
+		ConnectionResolver(r),
+		ConnectionTimeouts(Timeouts{Dial: 30 * time.Second}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.DialContext(ctx, "tcp", "smuggler.invalid:80")
+		done <- err
+	}()
+	// the lookup should be bounded by the dial timeout
+	deadline := <-r.deadlines
+	if d := time.Until(deadline); d < 20*time.Second || d > 30*time.Second {
+		t.Errorf("lookup deadline in %v, want the 30s dial timeout", d)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Error("expected the dial to fail")
+	}
+}
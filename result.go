@@ -0,0 +1,154 @@
+package h2csmuggler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+)
+
+// UpgradeResult describes the most recent attempt to upgrade a connection, whether or not it
+// succeeded. This allows for triaging why an upgrade failed without trace logging
+type UpgradeResult struct {
+	// Upgraded is true once the connection has switched to http2. For prior knowledge
+	// connections, this is once the preface and request have been written
+	Upgraded bool `json:"upgraded"`
+
+	// Response is the HTTP/1.1 response to the upgrade request. This is nil if no response
+	// was received, or with prior knowledge
+	Response *http2.UpgradeResponse `json:"response,omitempty"`
+
+	// ServerSettings are the server's initial http2 SETTINGS, in the order they were sent
+	ServerSettings []http2.Setting `json:"server_settings,omitempty"`
+
+	// EarlyData is the number of bytes of http2 data the server sent along with the 101,
+	// before it could have read the client preface. This is non-compliant, but tolerated
+	EarlyData int `json:"early_data,omitempty"`
+
+	// TLS is the negotiated tls state for https connections
+	TLS         *tls.ConnectionState `json:"-"`
+	TLSVersion  string               `json:"tls_version,omitempty"`
+	CipherSuite string               `json:"cipher_suite,omitempty"`
+	ALPN        string               `json:"alpn,omitempty"`
+
+	Timings UpgradeTimings `json:"timings"`
+}
+
+// UpgradeTimings are the durations of each phase of the upgrade. Phases which were not
+// reached are zero
+type UpgradeTimings struct {
+	Dial          time.Duration `json:"dial"`           // establishing the tcp connection, including any proxy
+	TLSHandshake  time.Duration `json:"tls_handshake"`  // completing the tls handshake
+	Upgrade       time.Duration `json:"upgrade"`        // sending the upgrade request until the 101
+	FirstResponse time.Duration `json:"first_response"` // the 101 until the response headers on stream 1
+	Total         time.Duration `json:"total"`
+}
+
+// setTLS will record the negotiated tls state of the connection
+func (r *UpgradeResult) setTLS(state tls.ConnectionState) {
+	r.TLS = &state
+	r.TLSVersion = tlsVersionName(state.Version)
+	r.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	r.ALPN = state.NegotiatedProtocol
+}
+
+// String will summarise the result on a single line
+func (r *UpgradeResult) String() string {
+	var parts []string
+	if r.Response != nil {
+		parts = append(parts, fmt.Sprintf("status=%q", r.Response.StatusLine))
+	}
+	parts = append(parts, fmt.Sprintf("upgraded=%v", r.Upgraded))
+	if len(r.ServerSettings) > 0 {
+		settings := make([]string, 0, len(r.ServerSettings))
+		for _, s := range r.ServerSettings {
+			settings = append(settings, fmt.Sprintf("%v=%d", s.ID, s.Val))
+		}
+		parts = append(parts, fmt.Sprintf("settings=%q", strings.Join(settings, ",")))
+	}
+	if r.EarlyData > 0 {
+		parts = append(parts, fmt.Sprintf("early_data=%d", r.EarlyData))
+	}
+	if r.TLS != nil {
+		parts = append(parts, "tls="+r.TLSVersion, "alpn="+r.ALPN)
+	}
+	parts = append(parts, fmt.Sprintf("total=%v", r.Timings.Total))
+	return strings.Join(parts, " ")
+}
+
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return "TLS" + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// upgradeRecorder records an upgrade attempt into an UpgradeResult as it progresses
+type upgradeRecorder struct {
+	result UpgradeResult
+	info   http2.UpgradeInfo
+	start  time.Time
+
+	mu      sync.Mutex
+	upgrade time.Time // when the upgrade request started being written
+	wrote   time.Time // when the upgrade completed and stream 1 was written
+}
+
+func newUpgradeRecorder() *upgradeRecorder {
+	return &upgradeRecorder{start: time.Now()}
+}
+
+// connected will record the connection once it is established
+func (r *upgradeRecorder) connected(conn net.Conn) {
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		r.result.setTLS(tlsconn.ConnectionState())
+	}
+	r.mu.Lock()
+	r.upgrade = time.Now()
+	r.mu.Unlock()
+}
+
+// trace will return the request with the recorder's hooks attached to its context
+func (r *upgradeRecorder) trace(req *http.Request) *http.Request {
+	ctx := http2.WithUpgradeInfo(req.Context(), &r.info)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.wrote.IsZero() {
+				r.wrote = time.Now()
+			}
+		},
+	})
+	return req.WithContext(ctx)
+}
+
+// finish will return the result of the attempt
+func (r *upgradeRecorder) finish() *UpgradeResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	ret := r.result
+	ret.Response = r.info.Response
+	ret.ServerSettings = r.info.ServerSettings
+	ret.EarlyData = r.info.EarlyData
+	if !r.upgrade.IsZero() {
+		if r.wrote.IsZero() {
+			ret.Timings.Upgrade = now.Sub(r.upgrade)
+		} else {
+			ret.Upgraded = true
+			ret.Timings.Upgrade = r.wrote.Sub(r.upgrade)
+			ret.Timings.FirstResponse = now.Sub(r.wrote)
+		}
+	}
+	ret.Timings.Total = now.Sub(r.start)
+	return &ret
+}
@@ -0,0 +1,179 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/hpack"
+)
+
+func TestConnUpgradeResult(t *testing.T) {
+	s := startH2CServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.UpgradeResult() != nil {
+		t.Fatalf("expected no result before upgrading")
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	r := c.UpgradeResult()
+	if !r.Upgraded {
+		t.Errorf("expected the result to be upgraded")
+	}
+	if r.Response == nil || r.Response.StatusLine != "HTTP/1.1 101 Switching Protocols" {
+		t.Errorf("got response %+v, want the 101", r.Response)
+	}
+	if len(r.ServerSettings) == 0 {
+		t.Errorf("expected the server settings to be recorded")
+	}
+	if r.Timings.Upgrade == 0 || r.Timings.Total < r.Timings.Upgrade+r.Timings.FirstResponse {
+		t.Errorf("got unexpected timings %+v", r.Timings)
+	}
+}
+
+func TestConnUpgradeResultFailure(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upgrade", "no")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("denied"))
+	}))
+	defer s.Close()
+
+	c, err := NewConn(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+
+	r := c.UpgradeResult()
+	if r.Upgraded {
+		t.Errorf("expected the result not to be upgraded")
+	}
+	if r.Response == nil || r.Response.StatusCode != http.StatusForbidden ||
+		r.Response.Header.Get("X-Upgrade") != "no" || string(r.Response.Body) != "denied" {
+		t.Errorf("got response %+v, want the 403", r.Response)
+	}
+	if len(r.ServerSettings) != 0 {
+		t.Errorf("got server settings %v, want none", r.ServerSettings)
+	}
+}
+
+func TestConnUpgradeResultTLS(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	s := startTLSH2CServer(t, hellos)
+	defer s.Close()
+
+	cfg := DefaultTLSConfig.Clone()
+	cfg.NextProtos = []string{"http/1.1"}
+	c, err := NewConn(s.URL, ConnectionTLSConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	r := c.UpgradeResult()
+	if r.TLS == nil || r.TLSVersion == "" || r.CipherSuite == "" {
+		t.Errorf("got tls %q %q, want the negotiated state", r.TLSVersion, r.CipherSuite)
+	}
+	if r.ALPN != "http/1.1" {
+		t.Errorf("got alpn %q, want http/1.1", r.ALPN)
+	}
+	if r.Timings.TLSHandshake == 0 {
+		t.Errorf("expected the tls handshake to be timed")
+	}
+}
+
+func TestConnUpgradeResultEarlyData(t *testing.T) {
+	// a server which writes its preface and the response to stream 1 in the same write as
+	// the 101, without waiting for the client preface
+	var frames bytes.Buffer
+	fr := http2.NewFramer(&frames, nil)
+	fr.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 7})
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true})
+	fr.WriteData(1, true, []byte("early"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+			return
+		}
+		c.Write(append([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"), frames.Bytes()...))
+		ioutil.ReadAll(c)
+	}()
+
+	target := "http://" + l.Addr().String()
+	c, err := NewConn(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "early" {
+		t.Errorf("got body %q, want early", body)
+	}
+
+	r := c.UpgradeResult()
+	if r.EarlyData != frames.Len() {
+		t.Errorf("got early data %d, want %d", r.EarlyData, frames.Len())
+	}
+	if len(r.ServerSettings) != 1 || r.ServerSettings[0].Val != 7 {
+		t.Errorf("got server settings %v, want the early SETTINGS", r.ServerSettings)
+	}
+}
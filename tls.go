@@ -0,0 +1,128 @@
+package h2csmuggler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultTLSConfig is used for https targets if no tls config is provided. Certificates
+	// are not verified, and no ALPN protocols are offered
+	DefaultTLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+)
+
+// ConnectionTLSConfig will use cfg when establishing tls connections. cfg is cloned for
+// each connection. This controls the ALPN protocols offered (NextProtos), the tls versions,
+// cipher suites and client certificates. Certificates are verified unless InsecureSkipVerify
+// is set. If ServerName is empty, the url hostname is sent as the SNI
+func ConnectionTLSConfig(cfg *tls.Config) ConnectionOption {
+	return func(c *Conn) {
+		c.tlsConfig = cfg
+	}
+}
+
+// ConnectionSNI will send sni as the tls server name instead of the url hostname. An empty
+// sni will omit the server name extension entirely. If certificate verification is enabled,
+// the certificate is still verified against the url hostname
+func ConnectionSNI(sni string) ConnectionOption {
+	return func(c *Conn) {
+		c.sni = &sni
+	}
+}
+
+// TLSConfig will return the tls config used for https connections to the conn's url
+func (c *Conn) TLSConfig() *tls.Config {
+	cfg := DefaultTLSConfig.Clone()
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	}
+
+	if c.sni == nil {
+		if cfg.ServerName == "" {
+			cfg.ServerName = c.url.Hostname()
+		}
+		return cfg
+	}
+
+	cfg.ServerName = *c.sni
+	if !cfg.InsecureSkipVerify && cfg.VerifyPeerCertificate == nil {
+		// the default verification checks the certificate against the server name, which is
+		// the sni we sent rather than the host we're targeting
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyHostname(cfg, c.url.Hostname())
+	}
+	return cfg
+}
+
+// verifyHostname will return a certificate verifier which validates the chain against the
+// roots in cfg, for the provided hostname
+func verifyHostname(cfg *tls.Config, hostname string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("h2csmuggler: no certificates presented")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.Wrap(err, "h2csmuggler: failed to parse certificate")
+			}
+			certs = append(certs, cert)
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			DNSName:       hostname,
+			Intermediates: x509.NewCertPool(),
+		}
+		if cfg.Time != nil {
+			opts.CurrentTime = cfg.Time()
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion will parse a tls version of the form 1.0, 1.1, 1.2 or 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("h2csmuggler: unknown tls version %q", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites will parse the cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// Insecure cipher suites are accepted, since they may be needed to reach older servers
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s.ID
+	}
+
+	ret := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("h2csmuggler: unknown cipher suite %q", name)
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
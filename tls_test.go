@@ -0,0 +1,127 @@
+package h2csmuggler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/assetnote/h2csmuggler/http2/h2c"
+)
+
+// startTLSH2CServer will start a https server which accepts h2c upgrades, and records the
+// client hello of each connection
+func startTLSH2CServer(t *testing.T, hellos chan<- *tls.ClientHelloInfo) *httptest.Server {
+	s := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &http2.Server{}))
+	s.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, nil
+		},
+	}
+	s.StartTLS()
+	return s
+}
+
+func doTLS(t *testing.T, target string, opts ...ConnectionOption) error {
+	c, err := NewConn(target, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func TestConnTLSClientHello(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	s := startTLSH2CServer(t, hellos)
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		opts      []ConnectionOption
+		wantSNI   string
+		wantProto []string
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:    "sni",
+			opts:    []ConnectionOption{ConnectionSNI("internal.example.com")},
+			wantSNI: "internal.example.com",
+		},
+		{
+			name:    "empty sni",
+			opts:    []ConnectionOption{ConnectionSNI("")},
+			wantSNI: "",
+		},
+		{
+			name:      "alpn",
+			opts:      []ConnectionOption{ConnectionTLSConfig(&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})},
+			wantProto: []string{"http/1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := doTLS(t, s.URL, tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			hello := <-hellos
+			if hello.ServerName != tt.wantSNI {
+				t.Errorf("got sni %q, want %q", hello.ServerName, tt.wantSNI)
+			}
+			if len(hello.SupportedProtos) != len(tt.wantProto) {
+				t.Errorf("got alpn %v, want %v", hello.SupportedProtos, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestConnTLSVerify(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	s := startTLSH2CServer(t, hellos)
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+
+	if err := doTLS(t, s.URL, ConnectionTLSConfig(&tls.Config{})); err == nil {
+		t.Errorf("expected verification against the system roots to fail")
+	}
+	<-hellos
+
+	if err := doTLS(t, s.URL, ConnectionTLSConfig(&tls.Config{RootCAs: roots})); err != nil {
+		t.Errorf("expected verification to succeed: %v", err)
+	}
+	<-hellos
+
+	// the certificate is still verified against the url host when the sni is overridden
+	if err := doTLS(t, s.URL, ConnectionTLSConfig(&tls.Config{RootCAs: roots}), ConnectionSNI("")); err != nil {
+		t.Errorf("expected verification to succeed: %v", err)
+	}
+	<-hellos
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for in, want := range map[string]uint16{"1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13} {
+		got, err := ParseTLSVersion(in)
+		if err != nil || got != want {
+			t.Errorf("ParseTLSVersion(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Errorf("expected error for unknown version")
+	}
+}
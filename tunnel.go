@@ -0,0 +1,53 @@
+package h2csmuggler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// The techniques used to establish a tunnel through a proxy to the backend
+const (
+	TechniqueH2C       = "h2c"       // upgrade the connection to h2c. See Conn
+	TechniqueWebSocket = "websocket" // upgrade the connection to a websocket. See WebSocketTunnel
+)
+
+// Techniques are the techniques which NewTunnel accepts
+var Techniques = []string{TechniqueH2C, TechniqueWebSocket}
+
+// Tunnel is a connection through a proxy to the backend, which requests are smuggled over.
+// The first request establishes the tunnel, and its response is received through the tunnel
+type Tunnel interface {
+	// Do will perform the request over the tunnel, establishing the tunnel with the request
+	// if it has not been initialized
+	Do(req *http.Request) (*http.Response, error)
+
+	// DoContext is like Do, however ctx is used in place of the request context
+	DoContext(ctx context.Context, req *http.Request) (*http.Response, error)
+
+	// DoUpgradeContext will establish the tunnel with the request. This can only be
+	// successfully called once
+	DoUpgradeContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error)
+
+	// Initialized will return whether the tunnel has been established
+	Initialized() bool
+
+	// UpgradeResult will return the result of the most recent attempt to establish the tunnel
+	UpgradeResult() *UpgradeResult
+
+	// Close will close the tunnel
+	Close()
+}
+
+// NewTunnel will return an uninitialized tunnel to target, established with the technique.
+// See NewConn and NewWebSocketTunnel
+func NewTunnel(technique string, target string, opts ...ConnectionOption) (Tunnel, error) {
+	switch technique {
+	case TechniqueH2C, "":
+		return NewConn(target, opts...)
+	case TechniqueWebSocket:
+		return NewWebSocketTunnel(target, opts...)
+	}
+	return nil, errors.Errorf("h2csmuggler: unknown technique %q", technique)
+}
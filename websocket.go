@@ -0,0 +1,311 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/assetnote/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	DefaultWebSocketUpgradeHeader    = "websocket"
+	DefaultWebSocketConnectionHeader = "Upgrade"
+	DefaultWebSocketVersion          = "13"
+)
+
+// SetWebSocketVersion will send val as the Sec-WebSocket-Version of websocket upgrades. An
+// unsupported version is rejected by the backend, however some proxies still treat the
+// connection as upgraded. This has no effect on h2c upgrades
+func SetWebSocketVersion(val string) UpgradeOption {
+	return func(o *UpgradeOptions) {
+		o.WebSocketVersion = val
+	}
+}
+
+// newWebSocketUpgradeOptions will return the default websocket upgrade options with opts
+// applied
+func newWebSocketUpgradeOptions(opts ...UpgradeOption) UpgradeOptions {
+	o := UpgradeOptions{
+		ConnectionHeader: DefaultWebSocketConnectionHeader,
+		UpgradeHeader:    DefaultWebSocketUpgradeHeader,
+		WebSocketVersion: DefaultWebSocketVersion,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WebSocketTunnel is a tunnel established by upgrading the connection to a websocket. Proxies
+// which only forward the Upgrade header for websockets may stop parsing the connection once it
+// is upgraded, and some do so regardless of whether the backend accepted the handshake.
+// The requests sent afterwards are written to the socket as HTTP/1.1, and reach the backend
+// without passing through the proxy's rules. Requests are sent one at a time.
+// A proxy which refuses the upgrade and keeps parsing the connection also answers these
+// requests, so if the upgrade response is not a 101, the first request is also sent without
+// the tunnel and the tunnel is only established if the responses differ
+type WebSocketTunnel struct {
+	c *Conn // dial configuration, the socket and the result of the upgrade
+
+	mu sync.Mutex // held for each request
+	br *bufio.Reader
+}
+
+// NewWebSocketTunnel will return an uninitialized websocket tunnel to target. The options are
+// the same as NewConn, however the http2 options have no effect. The upgrade options are
+// applied to the websocket upgrade, with the Upgrade header defaulting to websocket and the
+// Connection header defaulting to Upgrade
+func NewWebSocketTunnel(target string, opts ...ConnectionOption) (*WebSocketTunnel, error) {
+	c, err := NewConn(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketTunnel{c: c}, nil
+}
+
+// Initialized will return whether the tunnel has been established
+func (t *WebSocketTunnel) Initialized() bool {
+	return t.c.Initialized()
+}
+
+// UpgradeResult will return the result of the most recent attempt to establish the tunnel.
+// Upgraded is true once a request has been answered over the socket after a 101, or answered
+// differently from the same request sent without the tunnel
+func (t *WebSocketTunnel) UpgradeResult() *UpgradeResult {
+	return t.c.UpgradeResult()
+}
+
+// Close will close the socket
+func (t *WebSocketTunnel) Close() {
+	t.c.Close()
+}
+
+// Do will perform the request over the tunnel, establishing the tunnel with the request if it
+// has not been initialized. The request context is used for all phases
+func (t *WebSocketTunnel) Do(req *http.Request) (*http.Response, error) {
+	return t.DoContext(req.Context(), req)
+}
+
+// DoContext is like Do, however ctx is used in place of the request context
+func (t *WebSocketTunnel) DoContext(ctx context.Context, req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.c.Initialized() {
+		return t.upgrade(ctx, req)
+	}
+	return t.roundTrip(ctx, req, t.c.timeouts.Response)
+}
+
+// DoUpgradeContext will upgrade a new connection to a websocket with a GET of the request's
+// url and headers, then send the request over the socket. The upgrade succeeds if a response
+// to the request is received after a 101. Otherwise the request is sent again on a new
+// connection without the upgrade, and the upgrade succeeds if the status of the responses
+// differ, showing the proxy was bypassed. If they match, an UpgradeError of KindKeepAlive is
+// returned. The request body must be replayable with GetBody for the comparison. ctx bounds
+// the dial, the upgrade and the responses
+func (t *WebSocketTunnel) DoUpgradeContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.c.Initialized() {
+		return nil, errors.New("h2csmuggler: already initialized")
+	}
+	return t.upgrade(ctx, req, opts...)
+}
+
+// upgrade will establish the tunnel. The request lock must be held
+func (t *WebSocketTunnel) upgrade(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
+	o := newWebSocketUpgradeOptions(append(append([]UpgradeOption{}, t.c.upgradeOpts...), opts...)...)
+
+	var result UpgradeResult
+	start := time.Now()
+	defer func() {
+		result.Timings.Total = time.Since(start)
+		t.c.setUpgradeResult(&result)
+	}()
+
+	raw, err := webSocketUpgrade(req, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.c.conn != nil {
+		t.c.conn.Close()
+	}
+	t.c.conn, err = t.c.createConn(ctx, &result.Timings)
+	if err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: connection failed")
+	}
+	if tlsconn, ok := t.c.conn.(*tls.Conn); ok {
+		result.setTLS(tlsconn.ConnectionState())
+	}
+	t.br = bufio.NewReader(t.c.conn)
+
+	upgradeStart := time.Now()
+	err = withDeadline(ctx, t.c.conn, t.c.timeouts.Upgrade, func() error {
+		if _, err := t.c.conn.Write(raw); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(t.br, nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		result.Response = &http2.UpgradeResponse{
+			StatusLine: res.Proto + " " + res.Status,
+			StatusCode: res.StatusCode,
+			Header:     res.Header,
+			Body:       body,
+		}
+		return nil
+	})
+	result.Timings.Upgrade = time.Since(upgradeStart)
+	if err != nil {
+		t.c.conn.Close()
+		return nil, upgradeError(ctx, tunnelErrorKind(err), errors.Wrap(err, "h2csmuggler: websocket upgrade failed"))
+	}
+	log.WithFields(log.Fields{
+		"url":    req.URL.String(),
+		"status": result.Response.StatusCode,
+	}).Tracef("websocket upgrade response")
+
+	// without a response timeout, don't wait forever for a proxy which is still parsing
+	// the connection and holding the request back
+	timeout := t.c.timeouts.Response
+	if timeout == 0 {
+		timeout = t.c.timeouts.Upgrade
+	}
+	if timeout == 0 {
+		timeout = http2.DefaultH2CTimeout
+	}
+	firstStart := time.Now()
+	res, err := t.roundTrip(ctx, req, timeout)
+	result.Timings.FirstResponse = time.Since(firstStart)
+	if err != nil {
+		t.c.conn.Close()
+		return nil, upgradeError(ctx, tunnelErrorKind(err), errors.Wrap(err, "h2csmuggler: websocket tunnel failed"))
+	}
+
+	// a proxy which refused the upgrade may still be parsing the connection, in which case it
+	// answers the request the same as it would without the tunnel
+	if result.Response.StatusCode != http.StatusSwitchingProtocols {
+		direct, err := t.direct(ctx, req, timeout)
+		if err != nil {
+			t.c.conn.Close()
+			kind := ErrorKind(err) // dial failures are already classified
+			if kind == "" {
+				kind = tunnelErrorKind(err)
+			}
+			return nil, upgradeError(ctx, kind, errors.Wrap(err, "h2csmuggler: websocket comparison failed"))
+		}
+		log.WithFields(log.Fields{
+			"url":    req.URL.String(),
+			"tunnel": res.StatusCode,
+			"direct": direct.StatusCode,
+		}).Tracef("websocket comparison")
+		if direct.StatusCode == res.StatusCode {
+			t.c.conn.Close()
+			return nil, upgradeError(ctx, KindKeepAlive, errors.Errorf("h2csmuggler: websocket upgrade refused with %d, and the connection was kept alive", result.Response.StatusCode))
+		}
+	}
+	result.Upgraded = true
+	t.c.setInitialized()
+	return res, nil
+}
+
+// direct will send the request on a new connection without the upgrade, waiting at most
+// timeout for the response
+func (t *WebSocketTunnel) direct(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	// the body was consumed by the request over the socket
+	req, err := rewindRequest(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: rewind request")
+	}
+	conn, err := t.c.createConn(ctx, &UpgradeTimings{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return roundTripConn(ctx, conn, bufio.NewReader(conn), req, timeout)
+}
+
+// roundTrip will write the request to the socket and read the response, waiting at most
+// timeout if non-zero. The response body is read before returning. The request lock must
+// be held
+func (t *WebSocketTunnel) roundTrip(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	return roundTripConn(ctx, t.c.conn, t.br, req, timeout)
+}
+
+// roundTripConn will write the request to conn and read the response from br, waiting at
+// most timeout if non-zero. The response body is read before returning
+func roundTripConn(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	var res *http.Response
+	err := withDeadline(ctx, conn, timeout, func() error {
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		r, err := http.ReadResponse(br, req)
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		res = r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// webSocketUpgrade will return the websocket upgrade request for req. This is a GET of the
+// request's url with its headers, and without its body
+func webSocketUpgrade(req *http.Request, o UpgradeOptions) ([]byte, error) {
+	if o.Raw != nil {
+		return o.Raw.Render(req, o)
+	}
+
+	up, err := http.NewRequest(http.MethodGet, req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	up.Host = req.Host
+	up.Header = req.Header.Clone()
+	if !o.UpgradeHeaderDisabled {
+		up.Header.Set("Upgrade", o.UpgradeHeader)
+	}
+	if !o.ConnectionHeaderDisabled {
+		up.Header.Set("Connection", o.ConnectionHeader)
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	up.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	up.Header.Set("Sec-WebSocket-Version", o.WebSocketVersion)
+
+	var buf bytes.Buffer
+	if err := up.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
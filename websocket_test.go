@@ -0,0 +1,172 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startWebSocketServer will start a server which rejects websocket upgrades with a 426, and
+// otherwise responds with the method, path and body of the request. If close is set, the
+// connection is closed after rejecting the upgrade
+func startWebSocketServer(t *testing.T, close bool, versions chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			versions <- r.Header.Get("Sec-WebSocket-Version")
+			if close {
+				w.Header().Set("Connection", "close")
+			}
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+}
+
+// startBypassServer will start a server which acts like a proxy that forbids requests, other
+// than those sent after a websocket upgrade on the same connection. The upgrade is answered
+// with status, then the connection is treated as a tunnel to the backend, which responds with
+// the method, path and body of the request
+func startBypassServer(t *testing.T, status int, versions chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				tunneled := false
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := ioutil.ReadAll(req.Body)
+					res := &http.Response{ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+					switch {
+					case req.Header.Get("Upgrade") == "websocket":
+						versions <- req.Header.Get("Sec-WebSocket-Version")
+						res.StatusCode = status
+						tunneled = true
+					case tunneled:
+						res.StatusCode = http.StatusOK
+						body = []byte(req.Method + " " + req.URL.Path + " " + string(body))
+						res.Body = ioutil.NopCloser(bytes.NewReader(body))
+						res.ContentLength = int64(len(body))
+					default:
+						res.StatusCode = http.StatusForbidden
+					}
+					if status == http.StatusSwitchingProtocols && res.StatusCode == status {
+						res.Header.Set("Upgrade", "websocket")
+						res.Header.Set("Connection", "Upgrade")
+					}
+					res.Write(conn)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestWebSocketTunnel(t *testing.T) {
+	for _, status := range []int{http.StatusSwitchingProtocols, http.StatusUpgradeRequired} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			versions := make(chan string, 1)
+			l := startBypassServer(t, status, versions)
+			defer l.Close()
+			target := "http://" + l.Addr().String()
+
+			tun, err := NewTunnel(TechniqueWebSocket, target, ConnectionUpgradeOptions(SetWebSocketVersion("1337")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tun.Close()
+
+			for _, path := range []string{"/upgrade", "/smuggled"} {
+				req, err := http.NewRequest("POST", target+path, strings.NewReader("body"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := tun.Do(req)
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				body, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if got, want := string(body), "POST "+path+" body"; got != want {
+					t.Errorf("got body %q, want %q", got, want)
+				}
+			}
+
+			if v := <-versions; v != "1337" {
+				t.Errorf("got Sec-WebSocket-Version %q, want 1337", v)
+			}
+			r := tun.UpgradeResult()
+			if !r.Upgraded || r.Response == nil || r.Response.StatusCode != status {
+				t.Errorf("got result %+v, want upgraded after the %d", r, status)
+			}
+		})
+	}
+}
+
+func TestWebSocketTunnelKeepAlive(t *testing.T) {
+	// the server refuses the upgrade and answers the next request as it would without it
+	versions := make(chan string, 1)
+	s := startWebSocketServer(t, false, versions)
+	defer s.Close()
+
+	tun, err := NewWebSocketTunnel(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tun.Do(req); ErrorKind(err) != KindKeepAlive {
+		t.Fatalf("got err %v, want the connection to be kept alive", err)
+	}
+	<-versions
+	if r := tun.UpgradeResult(); r.Upgraded || r.Response == nil || r.Response.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("got result %+v, want the refused upgrade without the tunnel", r)
+	}
+}
+
+func TestWebSocketTunnelClosed(t *testing.T) {
+	versions := make(chan string, 1)
+	s := startWebSocketServer(t, true, versions)
+	defer s.Close()
+
+	tun, err := NewWebSocketTunnel(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tun.Do(req); ErrorKind(err) != KindClosed {
+		t.Fatalf("got err %v, want the tunnel to be closed", err)
+	}
+	if v := <-versions; v != DefaultWebSocketVersion {
+		t.Errorf("got Sec-WebSocket-Version %q, want %q", v, DefaultWebSocketVersion)
+	}
+	if r := tun.UpgradeResult(); r.Upgraded || r.Response == nil {
+		t.Errorf("got result %+v, want the upgrade response without the tunnel", r)
+	}
+}